@@ -218,7 +218,7 @@ func readInt64(b []byte) (i int64, err error) {
 		return
 	}
 	if isnfixint(lead) {
-		i = int64(lead)
+		i = int64(int8(lead))
 		return
 	}
 
@@ -4,13 +4,13 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/shabbyrobe/msgplens"
 )
@@ -24,12 +24,71 @@ Options:
   -inenc <enc>   Input encoding (optional)
   -outenc <enc>  Input encoding (optional)
   -extra         Allow extra data after input if the formats allow
+  -multi         Treat msgp input as a stream of concatenated objects and
+                 process every one of them
+  -maxdepth <n>  Maximum nesting depth of msgp input (0 for no limit)
+  -maxlen <n>    Maximum length of any array or map in msgp input
+  -maxelems <n>  Maximum total number of objects in msgp input
+  -exts <file>   Config file mapping msgp extension types to decoders. Each
+                 line holds a type and a decoder name, e.g. "1 uuid". Decoders:
+                 timestamp, uuid, decimal, bigint, msgpack, string, hex
+  -color <mode>  Color print and json output: auto (default), always or never.
+                 auto colors output to a terminal unless NO_COLOR is set
+  -theme <name>  Color theme for print and json output: dark (default), light,
+                 256, mono
+  -palette <p>   Override theme colors with comma separated field=sgr pairs,
+                 e.g. "int=32,string=38;5;117". Fields: attrname, attrvalue,
+                 keyindex, keytype, prefix, type, int, float, string, ext,
+                 error
+  -showbytes <n> Show at most n bytes of each string, bin or ext in print output
+  -showelems <n> Show at most n elements of each array or map in print output,
+                 skipping those in the middle
+  -showdepth <n> Collapse arrays and maps nested deeper than n in print output
+  -compact       Print map entries with scalar keys on one line in print output
+  -hexoff        Print offsets in hex in print output
+  -reloff        Print offsets relative to the containing array or map in print
+                 output
+  -showend       Print the end offset of each object in print output
+  -showpath      Print the path of each object in a column in print output
+  -indent <n>    Indent json output by n spaces. Defaults to 2 when writing to a
+                 terminal, otherwise json output is compact
+  -sortkeys      Sort the entries of each map in json input and output by key.
+                 By default, entries keep their order
+  -jsonkeys <p>  How json output writes map keys that aren't strings: string
+                 (default), error, or pairs to write the map as an array of
+                 [key, value] pairs
+  -jsonbin <p>   How json output writes bin data: base64 (default), hex, array
+  -jsonext <p>   How json output writes extensions without a decoder: object
+                 (default) for {"type":...,"data":...}, or drop
+  -jsonnan <p>   How json output writes NaN and infinite floats: error
+                 (default), null, string
+  -jsontime <layout>
+                 Convert json input strings that match this Go time layout to
+                 msgpack Timestamps. "rfc3339" is accepted as a shorthand for
+                 the layout json output uses for Timestamps
+  -jsonints <w>  Width of integers from json input: minimal (default) uses
+                 fixints and the smallest uint or int, signed uses the
+                 smallest int, 64 uses int64 (or uint64 if too large)
+  -jsonfloats <w>
+                 Width of floats from json input: 64 (default), smallest
+                 uses float32 if it holds the value exactly, 32
+  -jsondupes <p> What to do with duplicate keys in json input objects: keep
+                 (default) writes every entry, error fails
 
 Formats:
   msgp   Msgpack (default input, output)
   print  Pretty printed output (default output)
-  repr   Full representation of msgpack objects in JSON format (input, output)
+  repr   Full representation of msgpack objects in JSON format. Output is a
+         version 2 document; input may be version 1 or 2 (input, output)
   json   Lossy JSON approximation (input, output)
+  tagged Lossless JSON that is plain JSON wherever that is unambiguous, with
+         tags like {"$u16":1} or {"$bin":"01ff"} elsewhere (input, output)
+  explain
+         Table of every byte range in the input, with an explanation of what it
+         encodes (output)
+  annotated-hex
+         Hexdump with the bytes of each object marked out and annotated with
+         its path and type. Uses -color and -theme (output)
 
 Encodings:
   py3b   Python 3 binary string (input)
@@ -55,6 +114,24 @@ func run() error {
 		inEncoding  string
 		outEncoding string
 		extra       bool
+		multi       bool
+		jsonTime    string
+		extsFile    string
+		exts        *msgplens.ExtRegistry
+		colorMode   string
+		themeName   string
+		palette     string
+		jsonKeys    string
+		jsonBin     string
+		jsonExt     string
+		jsonNaN     string
+		jsonInts    string
+		jsonFloats  string
+		jsonDupes   string
+		printOpts   msgplens.PrinterOptions
+		jsonOpts    msgplens.JSONOptions
+		jsonDecOpts msgplens.JSONDecodeOptions
+		walkOpts    = msgplens.DefaultWalkOptions
 	)
 
 	if len(os.Args) == 1 {
@@ -76,8 +153,125 @@ func run() error {
 	flag.StringVar(&inEncoding, "inenc", "", "Input encoding")
 	flag.StringVar(&outEncoding, "outenc", "", "Output encoding")
 	flag.BoolVar(&extra, "extra", false, "Whether extra data after input is allowed")
+	flag.BoolVar(&multi, "multi", false, "Process every object in a stream of concatenated msgp objects")
+	flag.StringVar(&extsFile, "exts", "", "Config file mapping msgp extension types to decoders")
+	flag.StringVar(&colorMode, "color", "auto", "Color print and json output: auto, always or never")
+	flag.StringVar(&themeName, "theme", "dark", "Color theme for print and json output")
+	flag.StringVar(&palette, "palette", "", "Override theme colors with field=sgr pairs")
+	flag.IntVar(&printOpts.MaxBytes, "showbytes", 0, "Show at most n bytes of each string, bin or ext in print output")
+	flag.IntVar(&printOpts.MaxElements, "showelems", 0, "Show at most n elements of each array or map in print output")
+	flag.IntVar(&printOpts.MaxDepth, "showdepth", 0, "Collapse arrays and maps nested deeper than n in print output")
+	flag.BoolVar(&printOpts.Compact, "compact", false, "Print map entries with scalar keys on one line in print output")
+	flag.BoolVar(&printOpts.HexOffsets, "hexoff", false, "Print offsets in hex in print output")
+	flag.BoolVar(&printOpts.RelativeOffsets, "reloff", false, "Print offsets relative to the containing array or map in print output")
+	flag.BoolVar(&printOpts.ShowEnd, "showend", false, "Print the end offset of each object in print output")
+	flag.BoolVar(&printOpts.ShowPath, "showpath", false, "Print the path of each object in a column in print output")
+	flag.IntVar(&jsonOpts.Indent, "indent", -1, "Indent json output by n spaces")
+	flag.BoolVar(&jsonOpts.SortKeys, "sortkeys", false, "Sort the entries of each map in json input and output by key")
+	flag.StringVar(&jsonKeys, "jsonkeys", "string", "How json output writes map keys that aren't strings: string, error, pairs")
+	flag.StringVar(&jsonBin, "jsonbin", "base64", "How json output writes bin data: base64, hex, array")
+	flag.StringVar(&jsonExt, "jsonext", "object", "How json output writes extensions without a decoder: object, drop")
+	flag.StringVar(&jsonNaN, "jsonnan", "error", "How json output writes NaN and infinite floats: error, null, string")
+	flag.StringVar(&jsonInts, "jsonints", "minimal", "Width of integers from json input: minimal, signed, 64")
+	flag.StringVar(&jsonFloats, "jsonfloats", "64", "Width of floats from json input: 64, smallest, 32")
+	flag.StringVar(&jsonDupes, "jsondupes", "keep", "What to do with duplicate keys in json input objects: keep, error")
+	flag.StringVar(&jsonTime, "jsontime", "", "Go time layout of json input strings to convert to msgpack Timestamps")
+	flag.IntVar(&walkOpts.MaxDepth, "maxdepth", walkOpts.MaxDepth, "Maximum nesting depth of msgp input")
+	flag.IntVar(&walkOpts.MaxContainerLen, "maxlen", walkOpts.MaxContainerLen, "Maximum length of any array or map in msgp input")
+	flag.IntVar(&walkOpts.MaxElements, "maxelems", walkOpts.MaxElements, "Maximum total number of objects in msgp input")
 	flag.Parse()
 
+	if jsonTime == "rfc3339" {
+		jsonTime = time.RFC3339Nano
+	}
+
+	{
+		var err error
+		if printOpts.Color, err = msgplens.ParseColorMode(colorMode); err != nil {
+			return usageError{err.Error()}
+		}
+		theme, ok := msgplens.ThemeByName(themeName)
+		if !ok {
+			return usageError{fmt.Sprintf("Unknown theme %s", themeName)}
+		}
+		if theme, err = msgplens.ParseTheme(palette, theme); err != nil {
+			return usageError{err.Error()}
+		}
+		printOpts.Theme = &theme
+		jsonOpts.Color, jsonOpts.Theme = printOpts.Color, printOpts.Theme
+	}
+
+	{
+		var ok bool
+		if jsonOpts.Keys, ok = map[string]msgplens.JSONKeyPolicy{
+			"string": msgplens.JSONKeyString,
+			"error":  msgplens.JSONKeyError,
+			"pairs":  msgplens.JSONKeyPairs,
+		}[jsonKeys]; !ok {
+			return usageError{fmt.Sprintf("Unknown -jsonkeys policy %s", jsonKeys)}
+		}
+		if jsonOpts.Bin, ok = map[string]msgplens.JSONBinPolicy{
+			"base64": msgplens.JSONBinBase64,
+			"hex":    msgplens.JSONBinHex,
+			"array":  msgplens.JSONBinArray,
+		}[jsonBin]; !ok {
+			return usageError{fmt.Sprintf("Unknown -jsonbin policy %s", jsonBin)}
+		}
+		if jsonOpts.Ext, ok = map[string]msgplens.JSONExtPolicy{
+			"object": msgplens.JSONExtObject,
+			"drop":   msgplens.JSONExtDrop,
+		}[jsonExt]; !ok {
+			return usageError{fmt.Sprintf("Unknown -jsonext policy %s", jsonExt)}
+		}
+		if jsonOpts.NonFinite, ok = map[string]msgplens.JSONNonFinitePolicy{
+			"error":  msgplens.JSONNonFiniteError,
+			"null":   msgplens.JSONNonFiniteNull,
+			"string": msgplens.JSONNonFiniteString,
+		}[jsonNaN]; !ok {
+			return usageError{fmt.Sprintf("Unknown -jsonnan policy %s", jsonNaN)}
+		}
+		if jsonDecOpts.Ints, ok = map[string]msgplens.JSONIntWidth{
+			"minimal": msgplens.JSONIntMinimal,
+			"signed":  msgplens.JSONIntSigned,
+			"64":      msgplens.JSONIntAlways64,
+		}[jsonInts]; !ok {
+			return usageError{fmt.Sprintf("Unknown -jsonints width %s", jsonInts)}
+		}
+		if jsonDecOpts.Floats, ok = map[string]msgplens.JSONFloatWidth{
+			"64":       msgplens.JSONFloatAlways64,
+			"smallest": msgplens.JSONFloatSmallest,
+			"32":       msgplens.JSONFloatAlways32,
+		}[jsonFloats]; !ok {
+			return usageError{fmt.Sprintf("Unknown -jsonfloats width %s", jsonFloats)}
+		}
+		if jsonDecOpts.DuplicateKeys, ok = map[string]msgplens.JSONDuplicatePolicy{
+			"keep":  msgplens.JSONDuplicateKeep,
+			"error": msgplens.JSONDuplicateError,
+		}[jsonDupes]; !ok {
+			return usageError{fmt.Sprintf("Unknown -jsondupes policy %s", jsonDupes)}
+		}
+		jsonDecOpts.SortKeys = jsonOpts.SortKeys
+	}
+
+	if jsonOpts.Indent < 0 {
+		jsonOpts.Indent = 0
+		if !isPipedOut {
+			jsonOpts.Indent = 2
+		}
+	}
+
+	if extsFile != "" {
+		f, err := os.Open(extsFile)
+		if err != nil {
+			return err
+		}
+		exts, err = msgplens.LoadExtRegistry(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
 	if outFormat == "" {
 		if !isPipedOut && outEncoding == "" {
 			outFormat = "print"
@@ -142,92 +336,202 @@ func run() error {
 		return fmt.Errorf("unknown output encoding %s", outEncoding)
 	}
 
-	// FIXME: should try to use readers all the way
-	in, err := ioutil.ReadAll(rdr)
-	if err != nil {
-		return err
-	}
-
 	if inFormat == "msgp" && outFormat == "print" {
-		enc := msgplens.NewPrinter(wrt)
+		enc := msgplens.NewPrinterWithOptions(wrt, printOpts)
 		enc.AllowExtra = extra
-		if err := msgplens.WalkBytes(enc, in); err != nil {
+		enc.Extensions = exts
+		walk := walkOpts.WalkReader
+		if multi {
+			walk = walkOpts.WalkAllReader
+		}
+		if err := walk(enc, rdr); err != nil {
+			enc.Flush()
+			return err
+		}
+
+	} else if inFormat == "msgp" && outFormat == "annotated-hex" {
+		enc := msgplens.NewHexdump(wrt, printOpts)
+		enc.AllowExtra = extra
+		walk := walkOpts.WalkReader
+		if multi {
+			walk = walkOpts.WalkAllReader
+		}
+		if err := walk(enc, rdr); err != nil {
+			enc.Flush()
+			return err
+		}
+
+	} else if inFormat == "msgp" && outFormat == "explain" {
+		enc := msgplens.NewExplainer(wrt)
+		enc.AllowExtra = extra
+		enc.Extensions = exts
+		walk := walkOpts.WalkReader
+		if multi {
+			walk = walkOpts.WalkAllReader
+		}
+		if err := walk(enc, rdr); err != nil {
+			enc.Flush()
+			return err
+		}
+
+	} else if inFormat == "msgp" && outFormat == "json" {
+		enc := msgplens.NewJSONStreamEncoderWithOptions(wrt, jsonOpts)
+		enc.Extensions = exts
+		vis := msgplens.MultiVisitor(enc, &msgplens.Visitor{
+			End: func(ctx *msgplens.LensContext, left []byte) error {
+				if len(left) > 0 && !extra {
+					return fmt.Errorf("extra data in msgpack input %d", len(left))
+				}
+				return nil
+			},
+		})
+		walk := walkOpts.WalkReader
+		if multi {
+			walk = walkOpts.WalkAllReader
+		}
+		if err := walk(vis, rdr); err != nil {
+			enc.Flush()
 			return err
 		}
 
 	} else if inFormat == outFormat {
-		wrt.Write(in)
+		if _, err := io.Copy(wrt, rdr); err != nil {
+			return err
+		}
 
 	} else {
-		// Convert input into Node
-		var node msgplens.Node
+		// FIXME: should try to use readers all the way
+		in, err := ioutil.ReadAll(rdr)
+		if err != nil {
+			return err
+		}
+
+		// Convert input into Nodes
+		var nodes []msgplens.Node
+		var offsets []int
 		switch inFormat {
 		case "repr":
-			node, err = msgplens.ReprUnmarshalNode(in)
+			reprNodes, err := msgplens.ReprUnmarshal(in)
 			if err != nil {
 				return err
 			}
+			if len(reprNodes) == 0 {
+				return fmt.Errorf("no nodes in repr input")
+			}
+			if !multi && !extra && len(reprNodes) > 1 {
+				return fmt.Errorf("extra nodes in repr input")
+			}
+			nodes = append(nodes, reprNodes...)
+
+		case "tagged":
+			taggedNodes, err := msgplens.UnmarshalAllTaggedJSON(in)
+			if err != nil {
+				return err
+			}
+			if len(taggedNodes) == 0 {
+				return fmt.Errorf("no nodes in tagged input")
+			}
+			if !multi && !extra && len(taggedNodes) > 1 {
+				return fmt.Errorf("extra nodes in tagged input")
+			}
+			nodes = append(nodes, taggedNodes...)
 
 		case "json":
-			node, err = msgplens.UnmarshalJSON(in, extra)
+			jsonDecOpts.Extra, jsonDecOpts.TimeLayout = extra, jsonTime
+			node, err := msgplens.UnmarshalJSONOptions(in, jsonDecOpts)
 			if err != nil {
 				return err
 			}
+			nodes = append(nodes, node)
 
 		case "msgp":
 			repr := msgplens.NewRepresenter()
-			if err := msgplens.WalkBytes(repr, in); err != nil {
-				return err
-			}
-			nodes := repr.Nodes()
-			node = nodes[0]
-			bsz := node.TotalSize()
-			if !extra && len(nodes) > 1 {
-				return fmt.Errorf("extra data in msgpack input %d", bsz)
+			repr.Extensions = exts
+			if multi {
+				if err := walkOpts.WalkAllBytes(repr, in); err != nil {
+					return err
+				}
+				nodes, offsets = repr.Nodes(), repr.Offsets()
+			} else {
+				if err := walkOpts.WalkBytes(repr, in); err != nil {
+					return err
+				}
+				nodes = repr.Nodes()[:1]
+				bsz := nodes[0].TotalSize()
+				if !extra && len(repr.Nodes()) > 1 {
+					return fmt.Errorf("extra data in msgpack input %d", bsz)
+				}
 			}
 
 		default:
 			return usageError{fmt.Sprintf("Unknown input format %s", inFormat)}
 		}
 
-		// Render Node to output
+		var msgp bytes.Buffer
+		if outFormat != "repr" && outFormat != "tagged" {
+			for _, node := range nodes {
+				if err := node.Msgpack(&msgp); err != nil {
+					return err
+				}
+			}
+		}
+
+		walk := walkOpts.WalkBytes
+		if multi {
+			walk = walkOpts.WalkAllBytes
+		}
+
+		// Render Nodes to output
 		switch outFormat {
 		case "repr":
-			m, err := json.Marshal(node)
+			m, err := msgplens.ReprMarshalOffsets(nodes, offsets)
 			if err != nil {
-				panic(err)
+				return err
+			}
+			wrt.Write(append(m, '\n'))
+
+		case "tagged":
+			for _, node := range nodes {
+				m, err := msgplens.MarshalTaggedJSON(node)
+				if err != nil {
+					return err
+				}
+				wrt.Write(append(m, '\n'))
 			}
-			wrt.Write(m)
-			fmt.Println()
 
 		case "msgp":
-			var buf bytes.Buffer
-			if err := node.Msgpack(&buf); err != nil {
-				return err
-			}
-			wrt.Write(buf.Bytes())
+			wrt.Write(msgp.Bytes())
 
 		case "json":
-			var buf bytes.Buffer
-			if err := node.Msgpack(&buf); err != nil {
-				return err
-			}
-			enc := msgplens.NewJSONEncoder()
-			if err := msgplens.WalkBytes(enc, buf.Bytes()); err != nil {
+			enc := msgplens.NewJSONStreamEncoderWithOptions(wrt, jsonOpts)
+			enc.Extensions = exts
+			if err := walk(enc, msgp.Bytes()); err != nil {
+				enc.Flush()
 				return err
 			}
-			io.WriteString(wrt, enc.String())
 
 		case "print":
-			var buf bytes.Buffer
-			if err := node.Msgpack(&buf); err != nil {
+			enc := msgplens.NewPrinterWithOptions(wrt, printOpts)
+			enc.Extensions = exts
+			if err := walk(enc, msgp.Bytes()); err != nil {
 				return err
 			}
-			enc := msgplens.NewPrinter(wrt)
-			if err := msgplens.WalkBytes(enc, buf.Bytes()); err != nil {
+			if err := enc.Flush(); err != nil {
 				return err
 			}
-			if err := enc.Flush(); err != nil {
+
+		case "explain":
+			enc := msgplens.NewExplainer(wrt)
+			enc.Extensions = exts
+			if err := walk(enc, msgp.Bytes()); err != nil {
+				enc.Flush()
+				return err
+			}
+
+		case "annotated-hex":
+			enc := msgplens.NewHexdump(wrt, printOpts)
+			if err := walk(enc, msgp.Bytes()); err != nil {
+				enc.Flush()
 				return err
 			}
 
@@ -0,0 +1,359 @@
+package msgplens
+
+import (
+	"io"
+)
+
+// TokenKind identifies the kind of Token returned by a Decoder.
+type TokenKind int
+
+const (
+	InvalidToken TokenKind = iota
+
+	// ArrayStart and MapStart begin a container. Token.Count holds the number
+	// of elements or map entries that follow before the matching End.
+	ArrayStart
+	MapStart
+
+	// Key is a scalar map key. Keys that are arrays or maps are returned as
+	// ArrayStart or MapStart tokens with Token.Key set.
+	Key
+
+	// Scalar is any value that isn't an array or map.
+	Scalar
+
+	// End closes the innermost array or map.
+	End
+)
+
+// String implements fmt.Stringer
+func (k TokenKind) String() string {
+	switch k {
+	case ArrayStart:
+		return "array-start"
+	case MapStart:
+		return "map-start"
+	case Key:
+		return "key"
+	case Scalar:
+		return "scalar"
+	case End:
+		return "end"
+	default:
+		return "<invalid>"
+	}
+}
+
+// Token is a single step through a msgpack object returned by
+// Decoder.Next.
+type Token struct {
+	Kind   TokenKind
+	Type   Type
+	Prefix byte
+
+	// Offset is the position of the token's first byte in the input. For End
+	// tokens, it is the position just after the container.
+	Offset int
+
+	// Depth is the number of containers enclosing the token. The End token
+	// of a container has the same depth as its start token.
+	Depth int
+
+	// Key is true if the token starts a map key.
+	Key bool
+
+	// Count is the number of elements or map entries in a container. It is
+	// set for ArrayStart, MapStart and End tokens.
+	Count int
+
+	// Value is the decoded value of a Key or Scalar token. It is one of
+	// string, []byte, int64, uint64, float32, float64, bool, Extension or nil.
+	Value interface{}
+
+	// Raw is the full encoding of a Key or Scalar token, or the header of an
+	// ArrayStart or MapStart token. It is only valid until the next call to
+	// Next.
+	Raw []byte
+}
+
+// Extension is the decoded value of a msgpack extension object. Use
+// Timestamp to decode the spec-defined Timestamp extension.
+type Extension struct {
+	Type int8
+	Data []byte
+}
+
+// readExtension splits the encoding of an extension object into its type and
+// data.
+func readExtension(bts []byte) Extension {
+	hsz := headerSize(bts[0])
+	return Extension{Type: int8(bts[hsz-1]), Data: bts[hsz:]}
+}
+
+// writeExtension is the reverse of readExtension. The data must fit in the
+// extension prefix.
+func writeExtension(prefix byte, typ int8, data []byte) []byte {
+	n := len(data)
+	var hdr []byte
+	switch prefix {
+	case Ext8:
+		hdr = []byte{Ext8, byte(n), byte(typ)}
+	case Ext16:
+		hdr = []byte{Ext16, byte(n >> 8), byte(n), byte(typ)}
+	case Ext32:
+		hdr = []byte{Ext32, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n), byte(typ)}
+	default:
+		hdr = []byte{prefix, byte(typ)}
+	}
+	return append(hdr, data...)
+}
+
+// scalarValue decodes the full encoding of any object other than an array or
+// map.
+func scalarValue(typ Type, prefix byte, contents []byte) (interface{}, error) {
+	switch typ {
+	case StrType:
+		return string(contents[headerSize(prefix):]), nil
+	case BinType:
+		return contents[headerSize(prefix):], nil
+	case IntType:
+		return readInt64(contents)
+	case UintType:
+		return readUint64(contents)
+	case Float32Type:
+		return readFloat32(contents)
+	case Float64Type:
+		return readFloat64(contents)
+	case BoolType:
+		return contents[0] == True, nil
+	case NilType:
+		return nil, nil
+	case ExtensionType:
+		return readExtension(contents), nil
+	default:
+		return nil, ErrInvalidPrefix
+	}
+}
+
+// Decoder reads a stream of msgpack objects one Token at a time, as an
+// alternative to walking them with a Visitor. Consecutive objects in the
+// input are returned one after the other.
+type Decoder struct {
+	cursor
+	stack []decoderFrame
+	root  int
+	err   error
+
+	// entered is set when the last token returned started a container, so
+	// that Skip knows what to skip.
+	entered bool
+}
+
+type decoderFrame struct {
+	prefix byte
+	cnt    int
+	isMap  bool
+
+	// left is the number of objects remaining in the container. Each map
+	// entry counts as two.
+	left uintptr
+	n    int
+
+	key    interface{}
+	keySet bool
+}
+
+// NewDecoder returns a Decoder that reads incrementally from rdr, using
+// DefaultWalkOptions.
+func NewDecoder(rdr io.Reader) *Decoder {
+	return DefaultWalkOptions.NewDecoder(rdr)
+}
+
+// NewBytesDecoder returns a Decoder that reads from bts, using
+// DefaultWalkOptions. The Raw bytes of each Token alias bts.
+func NewBytesDecoder(bts []byte) *Decoder {
+	return DefaultWalkOptions.NewBytesDecoder(bts)
+}
+
+// NewDecoder returns a Decoder that reads incrementally from rdr, using
+// these options.
+func (o WalkOptions) NewDecoder(rdr io.Reader) *Decoder {
+	return &Decoder{cursor: cursor{opts: o, src: newReaderSource(rdr)}}
+}
+
+// NewBytesDecoder returns a Decoder that reads from bts, using these
+// options.
+func (o WalkOptions) NewBytesDecoder(bts []byte) *Decoder {
+	return &Decoder{cursor: cursor{opts: o, src: &bytesSource{bts: bts}}}
+}
+
+// Depth returns the number of containers that enclose the token most recently
+// returned by Next, which is the same as its Token.Depth.
+func (d *Decoder) Depth() int {
+	if d.entered {
+		return len(d.stack) - 1
+	}
+	return len(d.stack)
+}
+
+// Path returns the location of the token most recently returned by Next
+// relative to its top level object, in the same form as LensContext.Path.
+// The path of an End token is that of its container.
+func (d *Decoder) Path() Path {
+	stack := d.stack
+	if d.entered {
+		stack = stack[:len(stack)-1]
+	}
+	if len(stack) == 0 {
+		return nil
+	}
+	p := make(Path, len(stack))
+	for i := range stack {
+		f := &stack[i]
+		switch {
+		case !f.isMap:
+			p[i] = f.n - 1
+		case f.n%2 == 1 || !f.keySet:
+			p[i] = MapKey((f.n - 1) / 2)
+		default:
+			p[i] = f.key
+		}
+	}
+	return p
+}
+
+// Next returns the next Token in the input. It returns io.EOF once the
+// input is exhausted between top level objects. Any other error is a
+// *WalkError, and is returned again from all further calls.
+func (d *Decoder) Next() (tok Token, err error) {
+	if d.err != nil {
+		return tok, d.err
+	}
+	if tok, err = d.next(); err != nil && err != io.EOF {
+		d.err = d.failed(err)
+		return tok, d.err
+	}
+	return tok, err
+}
+
+func (d *Decoder) next() (tok Token, err error) {
+	d.entered = false
+
+	depth := len(d.stack)
+	if depth > 0 && d.stack[depth-1].left == 0 {
+		f := d.stack[depth-1]
+		d.stack = d.stack[:depth-1]
+		if len(d.stack) == 0 {
+			d.root++
+		}
+		return Token{
+			Kind:   End,
+			Type:   getType(f.prefix),
+			Prefix: f.prefix,
+			Offset: d.src.pos(),
+			Depth:  depth - 1,
+			Count:  f.cnt,
+		}, nil
+	}
+
+	if depth == 0 {
+		if next, err := d.src.peek(1); err != nil {
+			return tok, err
+		} else if len(next) == 0 {
+			return tok, io.EOF
+		}
+	}
+
+	var parent *decoderFrame
+	if depth > 0 {
+		parent = &d.stack[depth-1]
+		tok.Key = parent.isMap && parent.n%2 == 0
+		if tok.Key {
+			parent.keySet, parent.key = false, nil
+		}
+		parent.left--
+		parent.n++
+	}
+
+	prefix, sz, objs, err := d.header()
+	if err != nil {
+		return tok, err
+	}
+
+	tok.Prefix = prefix
+	tok.Type = getType(prefix)
+	tok.Offset = d.last
+	tok.Depth = depth
+
+	if tok.Type == ArrayType || tok.Type == MapType {
+		if err := d.checkDepth(depth); err != nil {
+			return tok, err
+		}
+	}
+
+	if tok.Raw, err = d.src.next(int(sz)); err != nil {
+		return tok, err
+	}
+
+	switch tok.Type {
+	case ArrayType:
+		tok.Kind = ArrayStart
+		tok.Count = int(objs)
+	case MapType:
+		tok.Kind = MapStart
+		tok.Count = int(objs) / 2
+	default:
+		tok.Kind = Scalar
+		if tok.Key {
+			tok.Kind = Key
+		}
+		if tok.Value, err = scalarValue(tok.Type, prefix, tok.Raw); err != nil {
+			return tok, err
+		}
+		if tok.Key && tok.Type != ExtensionType {
+			parent.key, parent.keySet = tok.Value, true
+		}
+		if depth == 0 {
+			d.root++
+		}
+		return tok, nil
+	}
+
+	d.stack = append(d.stack, decoderFrame{
+		prefix: prefix,
+		cnt:    tok.Count,
+		isMap:  tok.Kind == MapStart,
+		left:   objs,
+	})
+	d.entered = true
+	return tok, nil
+}
+
+// Skip skips the rest of the array or map whose start token was just
+// returned by Next, including its End token, without decoding it. After any
+// other token, Skip does nothing.
+func (d *Decoder) Skip() error {
+	if d.err != nil {
+		return d.err
+	}
+	if !d.entered {
+		return nil
+	}
+
+	// The container is still entered, so a failure is reported at its path:
+	depth := len(d.stack) - 1
+	if err := d.skip(d.stack[depth].left); err != nil {
+		d.err = d.failed(err)
+		return d.err
+	}
+	d.entered = false
+	d.stack = d.stack[:depth]
+	if depth == 0 {
+		d.root++
+	}
+	return nil
+}
+
+func (d *Decoder) failed(err error) error {
+	return d.walkError(err, d.root, d.Path(), true)
+}
@@ -0,0 +1,167 @@
+package msgplens
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestDecoderTokens(t *testing.T) {
+	expected := []string{
+		"map-start 0 0 2",
+		"key 1 1 a",
+		"array-start 3 1 5",
+		"scalar 4 2 1",
+		"scalar 5 2 -1",
+		"scalar 6 2 foo",
+		"scalar 10 2 true",
+		"scalar 11 2 <nil>",
+		"end 12 1 5",
+		"key 12 1 b",
+		"scalar 14 1 1.5",
+		"end 23 0 2",
+	}
+	expectedPaths := []string{
+		"", "/(key 0)", "/a", "/a/0", "/a/1", "/a/2", "/a/3", "/a/4", "/a", "/(key 1)", "/b", "",
+	}
+
+	for _, dec := range []*Decoder{
+		NewBytesDecoder(testObject),
+		NewDecoder(bytes.NewReader(testObject)),
+	} {
+		var found, paths []string
+		for {
+			tok, err := dec.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if dec.Depth() != tok.Depth {
+				t.Fatalf("%s at %d: depth %d != %d", tok.Kind, tok.Offset, dec.Depth(), tok.Depth)
+			}
+			paths = append(paths, dec.Path().String())
+			var v interface{} = tok.Value
+			if tok.Kind == ArrayStart || tok.Kind == MapStart || tok.Kind == End {
+				v = tok.Count
+			}
+			found = append(found, fmt.Sprintf("%s %d %d %v", tok.Kind, tok.Offset, tok.Depth, v))
+		}
+		if !reflect.DeepEqual(found, expected) {
+			t.Fatalf("%q != %q", found, expected)
+		}
+		if !reflect.DeepEqual(paths, expectedPaths) {
+			t.Fatalf("%q != %q", paths, expectedPaths)
+		}
+	}
+}
+
+func TestDecoderSkip(t *testing.T) {
+	dec := NewBytesDecoder(append(testObject, 0x01))
+	var found []interface{}
+	for {
+		tok, err := dec.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if tok.Kind == ArrayStart {
+			if err := dec.Skip(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tok.Kind == Key || tok.Kind == Scalar {
+			found = append(found, tok.Value)
+		}
+	}
+	expected := []interface{}{"a", "b", 1.5, int64(1)}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("%v != %v", found, expected)
+	}
+}
+
+func TestDecoderError(t *testing.T) {
+	dec := NewBytesDecoder([]byte{0x92, 0x01, 0xc1})
+	var err error
+	for err == nil {
+		_, err = dec.Next()
+	}
+	var werr *WalkError
+	if !errors.As(err, &werr) || werr.Err != ErrInvalidPrefix || werr.Path.String() != "/1" {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+// walkTokens drives a subset of the Visitor callbacks from a Decoder, to show
+// that the Visitor API can be built on top of the tokens.
+func walkTokens(vis *Visitor, dec *Decoder) error {
+	for {
+		tok, err := dec.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		switch tok.Kind {
+		case ArrayStart:
+			vis.EnterArray(nil, tok.Prefix, tok.Count)
+		case MapStart:
+			vis.EnterMap(nil, tok.Prefix, tok.Count)
+		case End:
+			if tok.Type == ArrayType {
+				vis.LeaveArray(nil, tok.Prefix, tok.Count, nil)
+			} else {
+				vis.LeaveMap(nil, tok.Prefix, tok.Count, nil)
+			}
+		case Key, Scalar:
+			switch v := tok.Value.(type) {
+			case string:
+				vis.Str(nil, tok.Raw, v)
+			case int64:
+				vis.Int(nil, tok.Raw, v)
+			case float64:
+				vis.Float64(nil, tok.Raw, v)
+			case bool:
+				vis.Bool(nil, tok.Raw, v)
+			case nil:
+				vis.Nil(nil, tok.Prefix)
+			}
+		}
+	}
+}
+
+func TestDecoderWalkEquivalence(t *testing.T) {
+	record := func(events *[]string) *Visitor {
+		add := func(f string, args ...interface{}) error {
+			*events = append(*events, fmt.Sprintf(f, args...))
+			return nil
+		}
+		return &Visitor{
+			Str:        func(ctx *LensContext, bts []byte, str string) error { return add("str %x %s", bts, str) },
+			Int:        func(ctx *LensContext, bts []byte, i int64) error { return add("int %x %d", bts, i) },
+			Float64:    func(ctx *LensContext, bts []byte, f float64) error { return add("float %x %g", bts, f) },
+			Bool:       func(ctx *LensContext, bts []byte, b bool) error { return add("bool %x %v", bts, b) },
+			Nil:        func(ctx *LensContext, prefix byte) error { return add("nil") },
+			EnterArray: func(ctx *LensContext, prefix byte, cnt int) error { return add("[ %d", cnt) },
+			LeaveArray: func(ctx *LensContext, prefix byte, cnt int, bts []byte) error { return add("] %d", cnt) },
+			EnterMap:   func(ctx *LensContext, prefix byte, cnt int) error { return add("{ %d", cnt) },
+			LeaveMap:   func(ctx *LensContext, prefix byte, cnt int, bts []byte) error { return add("} %d", cnt) },
+		}
+	}
+
+	var walked, decoded []string
+	if err := WalkBytes(record(&walked), testObject); err != nil {
+		t.Fatal(err)
+	}
+	if err := walkTokens(record(&decoded), NewBytesDecoder(testObject)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(walked, decoded) {
+		t.Fatalf("%q != %q", walked, decoded)
+	}
+}
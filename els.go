@@ -166,6 +166,20 @@ func prefixName(prefix byte) string {
 	return sizes[prefix].name
 }
 
+// headerSize returns the number of bytes that precede the payload of a str,
+// bin or extension object, or the total size of any other fixed size object.
+func headerSize(prefix byte) int {
+	spec := &sizes[prefix]
+	switch {
+	case spec.typ == StrType && spec.extra == constsize:
+		return 1 // fixstr
+	case spec.typ == ExtensionType && spec.extra == constsize:
+		return 2 // fixext
+	default:
+		return int(spec.size)
+	}
+}
+
 const last4 = 0x0f
 const first4 = 0xf0
 const last5 = 0x1f
@@ -250,19 +264,19 @@ func (t Type) String() string {
 func getSize(b []byte) (uintptr, uintptr, error) {
 	l := len(b)
 	if l == 0 {
-		return 0, 0, fmt.Errorf("short read")
+		return 0, 0, &shortReadError{expected: 1, available: 0}
 	}
 	lead := b[0]
 	spec := &sizes[lead] // get type information
 	size, mode := spec.size, spec.extra
 	if size == 0 {
-		return 0, 0, fmt.Errorf("invalid prefix %v", lead)
+		return 0, 0, ErrInvalidPrefix
 	}
 	if mode >= 0 { // fixed composites
 		return uintptr(size), uintptr(mode), nil
 	}
 	if l < int(size) {
-		return 0, 0, fmt.Errorf("short read")
+		return 0, 0, &shortReadError{expected: int(size), available: l}
 	}
 	switch mode {
 	case extra8:
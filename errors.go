@@ -0,0 +1,135 @@
+package msgplens
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrShortRead is returned when the input ends before an object does.
+	ErrShortRead = errors.New("short read")
+
+	// ErrInvalidPrefix is returned when a byte that can't start a msgpack
+	// object is found where one was expected.
+	ErrInvalidPrefix = errors.New("invalid prefix")
+
+	// ErrLimitExceeded is returned when the input exceeds one of the limits
+	// in the WalkOptions.
+	ErrLimitExceeded = errors.New("limit exceeded")
+
+	// ErrSkipChildren can be returned from a Visitor's EnterRoot, EnterArray,
+	// EnterMap, EnterArrayElem, EnterMapKey or EnterMapElem callback to skip
+	// the object that is being entered without visiting it. The matching
+	// Leave callback is still called. Returned from any other callback, it is
+	// ignored.
+	ErrSkipChildren = errors.New("skip children")
+
+	// ErrStopWalk can be returned from any Visitor callback to stop the walk
+	// immediately. The walk returns nil and Visitor.End is not called.
+	ErrStopWalk = errors.New("stop walk")
+)
+
+// WalkError is returned by the Walk functions when an object could not be
+// walked, either because the input is malformed or because a Visitor callback
+// returned an error.
+type WalkError struct {
+	// Offset is the absolute position of the object being walked when the
+	// failure occurred. For an error from EnterRoot or LeaveRoot it is the
+	// offset of the top level object, and for one from Begin or End it is
+	// the offset reached in the input.
+	Offset int
+
+	// Root is the index of the top level object that contains the failure.
+	Root int
+
+	// Prefix is the first byte of the object being walked. PrefixName is
+	// empty if the object had no bytes or the prefix is invalid.
+	Prefix     byte
+	PrefixName string
+
+	// Path is the location of the object being walked, relative to its top
+	// level object.
+	Path Path
+
+	// Expected is the number of bytes the object needed and Available is the
+	// number of bytes that remained in the input. Both are only set if Err
+	// is ErrShortRead.
+	Expected  int
+	Available int
+
+	Err error
+
+	hasPrefix bool
+	multi     bool
+}
+
+func (e *WalkError) Error() string {
+	msg := "walk failed"
+	if e.multi {
+		msg += fmt.Sprintf(" in object %d", e.Root)
+	}
+	msg += fmt.Sprintf(" at position %d", e.Offset)
+	if len(e.Path) > 0 {
+		msg += " (" + e.Path.String() + ")"
+	}
+	if e.hasPrefix {
+		msg += fmt.Sprintf(", prefix 0x%02x", e.Prefix)
+		if e.PrefixName != "" {
+			msg += " " + e.PrefixName
+		}
+	}
+	msg += ": " + e.Err.Error()
+	if e.Err == ErrShortRead {
+		msg += fmt.Sprintf(", expected %d bytes, %d available", e.Expected, e.Available)
+	}
+	return msg
+}
+
+func (e *WalkError) Unwrap() error { return e.Err }
+
+// walkError wraps an error encountered at the cursor's current position.
+func (c *cursor) walkError(err error, root int, path Path, multi bool) *WalkError {
+	werr := &WalkError{
+		Offset: c.last,
+		Root:   root,
+		Path:   path,
+		Err:    err,
+		multi:  multi,
+	}
+	if c.prefix >= 0 {
+		werr.hasPrefix = true
+		werr.Prefix = byte(c.prefix)
+		werr.PrefixName = prefixName(werr.Prefix)
+	}
+	if serr, ok := err.(*shortReadError); ok {
+		werr.Err = ErrShortRead
+		werr.Expected = serr.expected
+		werr.Available = serr.available
+	}
+	return werr
+}
+
+// shortReadError is used internally to carry the byte counts for an
+// ErrShortRead up to the WalkError.
+type shortReadError struct {
+	expected  int
+	available int
+}
+
+func (e *shortReadError) Error() string {
+	return fmt.Sprintf("%v, expected %d bytes, %d available", ErrShortRead, e.expected, e.available)
+}
+
+func (e *shortReadError) Unwrap() error { return ErrShortRead }
+
+type limitError struct {
+	limit string
+	max   int
+	found int
+}
+
+func (e *limitError) Error() string {
+	return fmt.Sprintf("%v: %s %d, maximum %d", ErrLimitExceeded, e.limit, e.found, e.max)
+}
+
+func (e *limitError) Unwrap() error { return ErrLimitExceeded }
@@ -0,0 +1,271 @@
+package msgplens
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+)
+
+// Explainer lists every byte range of a msgpack stream with an explanation of
+// what it encodes, like a protocol dissector:
+//
+//	0x00:      0x82                 Fixmap prefix, 2 entries in low 4 bits
+//	0x01:      0xa1                   Fixstr prefix, length 1 in low 5 bits, at /(key 0)
+//	0x02:      0x61                   string data "a", 1 bytes
+//
+// Explanations are indented by depth. When walking a reader, large str and
+// bin payloads are streamed, and only the bytes that are shown are kept.
+type Explainer struct {
+	vis *Visitor
+	w   *bufio.Writer
+
+	AllowExtra bool
+
+	// Extensions decodes extension objects. If nil, DefaultExtRegistry is
+	// used.
+	Extensions *ExtRegistry
+}
+
+const (
+	explainRangeLen = 10
+	explainValueLen = 20
+	explainValueMax = 8
+)
+
+func NewExplainer(out io.Writer) *Explainer {
+	e := &Explainer{w: bufio.NewWriter(out)}
+
+	scalar := func(ctx *LensContext, bts []byte) error {
+		e.explain(ctx, bts, -1)
+		return nil
+	}
+	e.vis = &Visitor{
+		Str:       func(ctx *LensContext, bts []byte, str string) error { return scalar(ctx, bts) },
+		Bin:       func(ctx *LensContext, bts []byte, data []byte) error { return scalar(ctx, bts) },
+		Int:       func(ctx *LensContext, bts []byte, data int64) error { return scalar(ctx, bts) },
+		Uint:      func(ctx *LensContext, bts []byte, data uint64) error { return scalar(ctx, bts) },
+		Float32:   func(ctx *LensContext, bts []byte, data float32) error { return scalar(ctx, bts) },
+		Float64:   func(ctx *LensContext, bts []byte, data float64) error { return scalar(ctx, bts) },
+		Bool:      func(ctx *LensContext, bts []byte, data bool) error { return scalar(ctx, bts) },
+		Extension: func(ctx *LensContext, bts []byte) error { return scalar(ctx, bts) },
+		Nil:       func(ctx *LensContext, prefix byte) error { return scalar(ctx, []byte{prefix}) },
+
+		StrStream: func(ctx *LensContext, prefix byte, size int, rdr io.Reader) error {
+			var b [5]byte
+			hdr, err := writeStringHeader(prefix, b[:], uint32(size))
+			if err != nil {
+				return err
+			}
+			return e.stream(ctx, hdr, size, rdr)
+		},
+
+		BinStream: func(ctx *LensContext, prefix byte, size int, rdr io.Reader) error {
+			var b [5]byte
+			hdr, err := writeBinHeader(prefix, b[:], uint32(size))
+			if err != nil {
+				return err
+			}
+			return e.stream(ctx, hdr, size, rdr)
+		},
+
+		EnterArray: func(ctx *LensContext, prefix byte, cnt int) error {
+			var b [5]byte
+			hdr, err := writeArrayHeader(prefix, b[:], uint32(cnt))
+			if err != nil {
+				return err
+			}
+			e.explain(ctx, hdr, cnt)
+			return nil
+		},
+
+		EnterMap: func(ctx *LensContext, prefix byte, cnt int) error {
+			var b [5]byte
+			hdr, err := writeMapHeader(prefix, b[:], uint32(cnt))
+			if err != nil {
+				return err
+			}
+			e.explain(ctx, hdr, cnt)
+			return nil
+		},
+
+		End: func(ctx *LensContext, left []byte) (err error) {
+			if len(left) > 0 {
+				pos := ctx.src.pos() - len(left)
+				e.row(pos, left, len(left), 0, fmt.Sprintf("extra data after the last object, %d bytes", len(left)))
+				if !e.AllowExtra {
+					err = fmt.Errorf("%d bytes found at end of input", len(left))
+				}
+			}
+			if ferr := e.Flush(); err == nil {
+				err = ferr
+			}
+			return err
+		},
+	}
+	return e
+}
+
+func (e *Explainer) Visitor() *Visitor {
+	return e.vis
+}
+
+func (e *Explainer) Flush() error {
+	return e.w.Flush()
+}
+
+// row writes one byte range of the input, which starts at pos and is size
+// bytes long. bts holds the range, or at least its first bytes.
+func (e *Explainer) row(pos int, bts []byte, size int, depth int, explanation string) {
+	rng := fmt.Sprintf("0x%02x:", pos)
+	if size > 1 {
+		rng = fmt.Sprintf("0x%02x-0x%02x:", pos, pos+size-1)
+	}
+
+	val := bts
+	if len(val) > explainValueMax {
+		val = val[:explainValueMax]
+	}
+	value := fmt.Sprintf("0x%x", val)
+	if len(val) < size {
+		value += "…"
+	}
+
+	fmt.Fprintf(e.w, "%-*s %-*s %s%s\n",
+		explainRangeLen, rng,
+		explainValueLen, value,
+		strings.Repeat("  ", depth), explanation)
+}
+
+// explain writes the rows for an object starting at ctx.Pos(). bts is the
+// full encoding of any object other than an array or map, or the header of
+// an array or map with cnt elements or entries.
+func (e *Explainer) explain(ctx *LensContext, bts []byte, cnt int) {
+	pos, depth := ctx.Pos(), ctx.Depth()
+	prefix := bts[0]
+	spec := &sizes[prefix]
+
+	// The prefix byte:
+	var expl string
+	switch {
+	case spec.name == "Fixint":
+		expl = fmt.Sprintf("Fixint, value %d in low 7 bits", prefix&last7)
+	case spec.name == "FixintNeg":
+		expl = fmt.Sprintf("FixintNeg, value %d in low 5 bits", int8(prefix))
+	case spec.name == "Fixstr":
+		expl = fmt.Sprintf("Fixstr prefix, length %d in low 5 bits", rfixstr(prefix))
+	case spec.name == "Fixmap":
+		expl = fmt.Sprintf("Fixmap prefix, %d entries in low 4 bits", rfixmap(prefix))
+	case spec.name == "Fixarray":
+		expl = fmt.Sprintf("Fixarray prefix, %d elements in low 4 bits", rfixarray(prefix))
+	case spec.typ == NilType || spec.typ == BoolType:
+		expl = spec.name
+	case spec.typ == ExtensionType && spec.extra == constsize:
+		expl = fmt.Sprintf("%s prefix, %d data bytes", spec.name, int(spec.size)-2)
+	default:
+		expl = spec.name + " prefix"
+	}
+	if path := ctx.Path().String(); path != "" {
+		expl += ", at " + path
+	}
+	e.row(pos, bts[:1], 1, depth, expl)
+
+	// The length field, if the prefix is followed by one:
+	off := 1
+	var lenSize int
+	switch spec.extra {
+	case extra8:
+		lenSize = 1
+	case extra16, map16v, array16v:
+		lenSize = 2
+	case extra32, map32v, array32v:
+		lenSize = 4
+	}
+	if lenSize > 0 {
+		var n uint64
+		for _, b := range bts[off : off+lenSize] {
+			n = n<<8 | uint64(b)
+		}
+		switch spec.typ {
+		case MapType:
+			expl = fmt.Sprintf("map length = %d entries", cnt)
+		case ArrayType:
+			expl = fmt.Sprintf("array length = %d elements", cnt)
+		case StrType:
+			expl = fmt.Sprintf("string length = %d bytes", n)
+		case BinType:
+			expl = fmt.Sprintf("bin length = %d bytes", n)
+		case ExtensionType:
+			expl = fmt.Sprintf("ext data length = %d bytes", n)
+		}
+		e.row(pos+off, bts[off:off+lenSize], lenSize, depth, expl)
+		off += lenSize
+	}
+
+	// The ext type code:
+	if spec.typ == ExtensionType {
+		typ := int8(bts[off])
+		expl = fmt.Sprintf("ext type = %d", typ)
+		if typ == TimestampType {
+			expl += " (timestamp)"
+		}
+		e.row(pos+off, bts[off:off+1], 1, depth, expl)
+		off++
+	}
+
+	// The payload:
+	payload := bts[off:]
+	if len(payload) == 0 || spec.typ == MapType || spec.typ == ArrayType {
+		return
+	}
+	switch spec.typ {
+	case StrType, BinType:
+		expl = explainData(spec.typ, payload, len(payload))
+	case ExtensionType:
+		expl = fmt.Sprintf("ext data, %d bytes", len(payload))
+		if v, ok := e.Extensions.decodeExt(bts); ok && v.Display != "" {
+			expl += " = " + v.Display
+		}
+	case IntType, UintType, Float32Type, Float64Type:
+		v, err := scalarValue(spec.typ, prefix, bts)
+		if err != nil {
+			return
+		}
+		expl = fmt.Sprintf("%s value = %v", strings.ToLower(spec.name), v)
+	}
+	e.row(pos+off, payload, len(payload), depth, expl)
+}
+
+// stream writes the rows for a str or bin with the header hdr, whose payload
+// of size bytes is read from rdr. Only the bytes that are shown are kept.
+func (e *Explainer) stream(ctx *LensContext, hdr []byte, size int, rdr io.Reader) error {
+	e.explain(ctx, hdr, -1)
+	head, err := ioutil.ReadAll(io.LimitReader(rdr, explainValueMax*2+utf8.UTFMax))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(ioutil.Discard, rdr); err != nil {
+		return err
+	}
+	if size > 0 {
+		expl := explainData(getType(hdr[0]), head, size)
+		e.row(ctx.Pos()+len(hdr), head, size, ctx.Depth(), expl)
+	}
+	return nil
+}
+
+// explainData explains the payload of a str or bin of size bytes, of which
+// head holds at least the first bytes.
+func explainData(typ Type, head []byte, size int) string {
+	if typ == BinType {
+		return fmt.Sprintf("bin data, %d bytes", size)
+	}
+	s := truncateString(string(head), explainValueMax*2)
+	expl := fmt.Sprintf("string data %q", s)
+	if len(s) < size {
+		expl += "…"
+	}
+	return expl + fmt.Sprintf(", %d bytes", size)
+}
@@ -0,0 +1,81 @@
+package msgplens
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExplainer(t *testing.T) {
+	var out bytes.Buffer
+	if err := WalkBytes(NewExplainer(&out), []byte{0xde, 0x00, 0x01, 0xa1, 'a', 0xd1, 0xff, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	exp := "" +
+		"0x00:      0xde                 Map16 prefix\n" +
+		"0x01-0x02: 0x0001               map length = 1 entries\n" +
+		"0x03:      0xa1                   Fixstr prefix, length 1 in low 5 bits, at /(key 0)\n" +
+		"0x04:      0x61                   string data \"a\", 1 bytes\n" +
+		"0x05:      0xd1                   Int16 prefix, at /a\n" +
+		"0x06-0x07: 0xff00                 int16 value = -256\n"
+	if out.String() != exp {
+		t.Fatalf("\n%s\n!=\n%s", out.String(), exp)
+	}
+}
+
+func TestExplainerLengthsAndTypes(t *testing.T) {
+	// ["ab" as Str8, bin(0x01 0x02), ext8(5, "y"), fixext1(-2, "z")]
+	in := []byte{
+		0x94,
+		Str8, 0x02, 'a', 'b',
+		Bin8, 0x02, 0x01, 0x02,
+		Ext8, 0x01, 0x05, 'y',
+		Fixext1, 0xfe, 'z',
+	}
+	var out bytes.Buffer
+	if err := WalkBytes(NewExplainer(&out), in); err != nil {
+		t.Fatal(err)
+	}
+	exp := "" +
+		"0x00:      0x94                 Fixarray prefix, 4 elements in low 4 bits\n" +
+		"0x01:      0xd9                   Str8 prefix, at /0\n" +
+		"0x02:      0x02                   string length = 2 bytes\n" +
+		"0x03-0x04: 0x6162                 string data \"ab\", 2 bytes\n" +
+		"0x05:      0xc4                   Bin8 prefix, at /1\n" +
+		"0x06:      0x02                   bin length = 2 bytes\n" +
+		"0x07-0x08: 0x0102                 bin data, 2 bytes\n" +
+		"0x09:      0xc7                   Ext8 prefix, at /2\n" +
+		"0x0a:      0x01                   ext data length = 1 bytes\n" +
+		"0x0b:      0x05                   ext type = 5\n" +
+		"0x0c:      0x79                   ext data, 1 bytes\n" +
+		"0x0d:      0xd4                   Fixext1 prefix, 1 data bytes, at /3\n" +
+		"0x0e:      0xfe                   ext type = -2\n" +
+		"0x0f:      0x7a                   ext data, 1 bytes\n"
+	if out.String() != exp {
+		t.Fatalf("\n%s\n!=\n%s", out.String(), exp)
+	}
+}
+
+func TestExplainerStream(t *testing.T) {
+	sz := readerStreamThreshold * 2
+	for _, prefix := range []byte{Str32, Bin32} {
+		in := []byte{prefix, 0, 0, 0, 0}
+		big.PutUint32(in[1:], uint32(sz))
+		in = append(in, strings.Repeat("é", sz/2)...)
+
+		var bout, rout bytes.Buffer
+		if err := WalkBytes(NewExplainer(&bout), in); err != nil {
+			t.Fatal(err)
+		}
+		e := NewExplainer(&rout)
+		if e.Visitor().StrStream == nil || e.Visitor().BinStream == nil {
+			t.Fatal("explainer does not stream")
+		}
+		if err := WalkReader(e, bytes.NewReader(in)); err != nil {
+			t.Fatal(err)
+		}
+		if bout.String() != rout.String() {
+			t.Fatalf("streamed output differs:\n%s\n%s", bout.String(), rout.String())
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package msgplens
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	bignum "math/big"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ExtValue is the result of decoding an extension object with an ExtDecoder.
+type ExtValue struct {
+	// Display is shown by Printer after the extension's type.
+	Display string
+
+	// JSON is the value JSONEncoder writes in place of the extension, and
+	// Representer stores in ExtensionNode.Value. It is marshalled with
+	// encoding/json.
+	JSON interface{}
+
+	// Msgpack, if set, is a msgpack document contained in the extension.
+	// Printer walks it beneath the extension, and JSONEncoder writes it in
+	// place of the extension if JSON is nil.
+	Msgpack []byte
+}
+
+// ExtDecoder decodes the data of an extension object of type typ.
+type ExtDecoder func(typ int8, data []byte) (ExtValue, error)
+
+// ExtRegistry maps extension types to the ExtDecoders used by Printer,
+// JSONEncoder and Representer. Extensions of a type with no decoder are
+// treated as opaque.
+type ExtRegistry struct {
+	decoders map[int8]ExtDecoder
+}
+
+// DefaultExtRegistry is used by Printer, JSONEncoder and Representer when
+// they are not given an ExtRegistry.
+var DefaultExtRegistry = NewExtRegistry()
+
+// NewExtRegistry returns an ExtRegistry that decodes Timestamp extensions.
+func NewExtRegistry() *ExtRegistry {
+	r := &ExtRegistry{decoders: make(map[int8]ExtDecoder)}
+	r.Register(TimestampType, DecodeTimestampExt)
+	return r
+}
+
+// LoadExtRegistry reads an ExtRegistry from a config file. Each line of the
+// file contains an extension type followed by the name of a built-in
+// decoder:
+//
+//	# type  decoder
+//	1       uuid
+//	2       decimal
+//	3       bigint
+//	4       msgpack
+//
+// Blank lines and lines starting with '#' are ignored. The built-in decoders
+// are timestamp, uuid, decimal, bigint, msgpack, string and hex. The
+// Timestamp extension is decoded unless the file says otherwise.
+func LoadExtRegistry(rdr io.Reader) (*ExtRegistry, error) {
+	r := NewExtRegistry()
+	scn := bufio.NewScanner(rdr)
+	line := 0
+	for scn.Scan() {
+		line++
+		text := strings.TrimSpace(scn.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("ext config line %d: expected type and decoder, found %q", line, text)
+		}
+		typ, err := strconv.ParseInt(fields[0], 0, 8)
+		if err != nil {
+			return nil, fmt.Errorf("ext config line %d: invalid type %q", line, fields[0])
+		}
+		dec, ok := extDecoders[fields[1]]
+		if !ok {
+			return nil, fmt.Errorf("ext config line %d: unknown decoder %q", line, fields[1])
+		}
+		r.Register(int8(typ), dec)
+	}
+	if err := scn.Err(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Register sets the decoder for extensions of type typ, replacing any
+// existing decoder. If dec is nil, the type is treated as opaque.
+func (r *ExtRegistry) Register(typ int8, dec ExtDecoder) {
+	if dec == nil {
+		delete(r.decoders, typ)
+	} else {
+		r.decoders[typ] = dec
+	}
+}
+
+// Decode decodes ext using the decoder registered for its type. ok is false
+// if there is no decoder for the type.
+func (r *ExtRegistry) Decode(ext Extension) (v ExtValue, ok bool, err error) {
+	dec := r.decoders[ext.Type]
+	if dec == nil {
+		return v, false, nil
+	}
+	v, err = dec(ext.Type, ext.Data)
+	return v, true, err
+}
+
+// decodeExt decodes the full encoding of an extension object. It returns
+// false if there is no decoder for the object, or if the decoder fails.
+func (r *ExtRegistry) decodeExt(bts []byte) (v ExtValue, ok bool) {
+	v, ok, err := r.orDefault().Decode(readExtension(bts))
+	return v, ok && err == nil
+}
+
+func (r *ExtRegistry) orDefault() *ExtRegistry {
+	if r == nil {
+		return DefaultExtRegistry
+	}
+	return r
+}
+
+var extDecoders = map[string]ExtDecoder{
+	"timestamp": DecodeTimestampExt,
+	"uuid":      DecodeUUIDExt,
+	"decimal":   DecodeDecimalExt,
+	"bigint":    DecodeBigIntExt,
+	"msgpack":   DecodeMsgpackExt,
+	"string":    DecodeStringExt,
+	"hex":       DecodeHexExt,
+}
+
+// DecodeTimestampExt decodes a msgpack Timestamp as an RFC 3339 string.
+func DecodeTimestampExt(typ int8, data []byte) (ExtValue, error) {
+	t, ok := Extension{Type: TimestampType, Data: data}.Timestamp()
+	if !ok {
+		return ExtValue{}, fmt.Errorf("invalid timestamp")
+	}
+	s := t.Format(time.RFC3339Nano)
+	return ExtValue{Display: s, JSON: s}, nil
+}
+
+// DecodeUUIDExt decodes a 16 byte UUID as a string in the canonical
+// hyphenated form.
+func DecodeUUIDExt(typ int8, data []byte) (ExtValue, error) {
+	if len(data) != 16 {
+		return ExtValue{}, fmt.Errorf("uuid expected 16 bytes, found %d", len(data))
+	}
+	h := hex.EncodeToString(data)
+	s := h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+	return ExtValue{Display: s, JSON: s}, nil
+}
+
+// DecodeDecimalExt decodes a decimal number stored as text, such as
+// "-12.345". It is written to JSON as a number, without loss of precision.
+func DecodeDecimalExt(typ int8, data []byte) (ExtValue, error) {
+	s := string(data)
+	if _, ok := new(bignum.Float).SetString(s); !ok || !json.Valid(data) {
+		return ExtValue{}, fmt.Errorf("invalid decimal %q", s)
+	}
+	return ExtValue{Display: s, JSON: json.Number(s)}, nil
+}
+
+// DecodeBigIntExt decodes an integer stored as big-endian two's complement
+// bytes. It is written to JSON as a number, without loss of precision.
+func DecodeBigIntExt(typ int8, data []byte) (ExtValue, error) {
+	i := new(bignum.Int).SetBytes(data)
+	if len(data) > 0 && data[0]&0x80 != 0 {
+		i.Sub(i, new(bignum.Int).Lsh(bignum.NewInt(1), uint(len(data)*8)))
+	}
+	s := i.String()
+	return ExtValue{Display: s, JSON: json.Number(s)}, nil
+}
+
+// DecodeMsgpackExt decodes an extension that contains a msgpack document.
+func DecodeMsgpackExt(typ int8, data []byte) (ExtValue, error) {
+	return ExtValue{Msgpack: data}, nil
+}
+
+// DecodeStringExt decodes an extension that contains UTF-8 text.
+func DecodeStringExt(typ int8, data []byte) (ExtValue, error) {
+	if !utf8.Valid(data) {
+		return ExtValue{}, fmt.Errorf("invalid utf-8 string")
+	}
+	s := string(data)
+	return ExtValue{Display: strconv.Quote(s), JSON: s}, nil
+}
+
+// DecodeHexExt decodes an extension as a string of hex digits.
+func DecodeHexExt(typ int8, data []byte) (ExtValue, error) {
+	s := hex.EncodeToString(data)
+	return ExtValue{Display: s, JSON: s}, nil
+}
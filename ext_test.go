@@ -0,0 +1,107 @@
+package msgplens
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestExtRegistry(t *testing.T) {
+	reg, err := LoadExtRegistry(strings.NewReader(`
+		# type  decoder
+		1       uuid
+		2       bigint
+		0x03    msgpack
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := []byte{0x94,
+		Fixext16, 1, 0x12, 0x3e, 0x45, 0x67, 0xe8, 0x9b, 0x12, 0xd3, 0xa4, 0x56, 0x42, 0x66, 0x14, 0x17, 0x40, 0x00,
+		Fixext2, 2, 0xff, 0x00,
+		Ext8, 3, 3, 0x91, 0xa1, 'x',
+		Fixext1, 5, 'y',
+	}
+
+	enc := NewJSONEncoder()
+	enc.Extensions = reg
+	if err := WalkBytes(enc, in); err != nil {
+		t.Fatal(err)
+	}
+	exp := `["123e4567-e89b-12d3-a456-426614174000",-256,["x"],{"type":5,"data":"eQ=="}]`
+	if enc.String() != exp {
+		t.Fatalf("%s != %s", enc.String(), exp)
+	}
+
+	var out bytes.Buffer
+	p := NewPrinter(&out)
+	p.Extensions = reg
+	if err := WalkBytes(p, in); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"123e4567-e89b-12d3-a456-426614174000", "-256", `"x"`} {
+		if !strings.Contains(out.String(), s) {
+			t.Fatalf("%q not printed:\n%s", s, out.String())
+		}
+	}
+
+	repr := NewRepresenter()
+	repr.Extensions = reg
+	if err := WalkBytes(repr, in); err != nil {
+		t.Fatal(err)
+	}
+	ext := repr.Nodes()[0].(*ArrayNode).Children[2].(*ExtensionNode)
+	if len(ext.Document) != 1 {
+		t.Fatalf("expected document, found %v", ext.Document)
+	}
+}
+
+func TestExtRegistryNestedLimits(t *testing.T) {
+	reg := NewExtRegistry()
+	reg.Register(7, DecodeMsgpackExt)
+
+	// [ext7([ext7([ext7([1])])])] is 7 levels deep, counting each nested
+	// document as a level, with 8 objects:
+	in := []byte{0x91, 0x01}
+	for i := 0; i < 3; i++ {
+		in = append([]byte{0x91, Ext8, byte(len(in)), 7}, in...)
+	}
+
+	for _, opts := range []WalkOptions{{MaxDepth: 2}, {MaxDepth: 6}, {MaxElements: 7}} {
+		var out bytes.Buffer
+		p := NewPrinter(&out)
+		p.Extensions = reg
+		enc := NewJSONEncoder()
+		enc.Extensions = reg
+		repr := NewRepresenter()
+		repr.Extensions = reg
+
+		for _, v := range []Visitable{p, enc, repr} {
+			err := opts.WalkBytes(v, in)
+			if !errors.Is(err, ErrLimitExceeded) {
+				t.Fatalf("%T with %+v: expected limit error, found %v", v, opts, err)
+			}
+		}
+	}
+
+	for _, opts := range []WalkOptions{{MaxDepth: 7}, {MaxElements: 8}} {
+		enc := NewJSONEncoder()
+		enc.Extensions = reg
+		if err := opts.WalkBytes(enc, in); err != nil {
+			t.Fatal(err)
+		}
+		if enc.String() != "[[[[1]]]]" {
+			t.Fatalf("unexpected JSON %s", enc.String())
+		}
+	}
+}
+
+func TestLoadExtRegistryError(t *testing.T) {
+	for _, in := range []string{"1", "1 nope", "300 uuid"} {
+		if _, err := LoadExtRegistry(strings.NewReader(in)); err == nil {
+			t.Fatalf("expected error for %q", in)
+		}
+	}
+}
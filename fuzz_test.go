@@ -0,0 +1,83 @@
+package msgplens
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+var fuzzWalkOptions = WalkOptions{
+	MaxDepth:        64,
+	MaxContainerLen: 1 << 16,
+	MaxElements:     1 << 16,
+	Strict:          true,
+}
+
+func FuzzWalk(f *testing.F) {
+	f.Add(testObject)
+	f.Add([]byte{Str32, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{Array32, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{Map32, 0xff, 0xff, 0xff, 0xff, 0x01})
+	f.Add([]byte{0x91, 0x91, 0x91, 0x91, 0x91, 0x90})
+	f.Add([]byte{Fixext4, 0xff, 0, 0, 0, 0, Ext8, 12, 0xff})
+
+	f.Fuzz(func(t *testing.T, in []byte) {
+		for _, v := range []Visitable{NewPrinter(ioutil.Discard), NewJSONEncoder()} {
+			_ = fuzzWalkOptions.WalkAllBytes(v, in)
+		}
+		for _, v := range []Visitable{NewPrinter(ioutil.Discard), NewJSONEncoder()} {
+			_ = fuzzWalkOptions.WalkAllReader(v, bytes.NewReader(in))
+		}
+
+		// Anything that walks successfully must survive the round trip
+		// through the Representer:
+		repr := NewRepresenter()
+		if err := fuzzWalkOptions.WalkAllBytes(repr, in); err != nil {
+			return
+		}
+		var out bytes.Buffer
+		for _, n := range repr.Nodes() {
+			if err := n.Msgpack(&out); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(in, out.Bytes()) {
+			t.Fatalf("round trip failed:\n%x\n%x", in, out.Bytes())
+		}
+	})
+}
+
+func FuzzReprUnmarshalNode(f *testing.F) {
+	f.Add([]byte(`{"Prefix":205,"Size":3,"Bits":"AAAAAAAAAQA=","Approx":256}`))
+	f.Add([]byte(`{"Prefix":145,"Size":1,"Children":[{"Prefix":192,"Size":1}]}`))
+	f.Add([]byte(`{"Prefix":129,"Size":1,"Values":[{"Key":{"Prefix":161,"Size":1,"Value":"a"},"Value":{"Prefix":195,"Size":1,"Value":true}}]}`))
+	f.Add([]byte(`{"Prefix":203,"Bits":""}`))
+
+	f.Fuzz(func(t *testing.T, in []byte) {
+		node, err := ReprUnmarshalNode(in)
+		if err != nil {
+			return
+		}
+		var out bytes.Buffer
+		_ = node.Msgpack(&out)
+		_ = fuzzWalkOptions.WalkAllBytes(NewRepresenter(), out.Bytes())
+	})
+}
+
+func FuzzUnmarshalJSON(f *testing.F) {
+	f.Add([]byte(`{"a": [1, -1, "foo", true, null], "b": 1.5}`))
+	f.Add([]byte(`[18446744073709551615, -9223372036854775808, 1e400]`))
+	f.Add([]byte(`"` + string(bytes.Repeat([]byte{'a'}, 300)) + `"`))
+
+	f.Fuzz(func(t *testing.T, in []byte) {
+		node, err := UnmarshalJSON(in, true)
+		if err != nil {
+			return
+		}
+		var out bytes.Buffer
+		if err := node.Msgpack(&out); err != nil {
+			return
+		}
+		_ = fuzzWalkOptions.WalkAllBytes(NewRepresenter(), out.Bytes())
+	})
+}
@@ -0,0 +1,122 @@
+package msgplens
+
+import "io"
+
+// Handler is an interface equivalent of Visitor, for visitors that are more
+// naturally written as a type with methods. Embed BaseHandler to get no-op
+// implementations of the methods you don't need, then pass the Handler to
+// NewHandlerVisitor to walk with it.
+//
+// The methods have the same meaning as the Visitor fields of the same name.
+type Handler interface {
+	Begin(ctx *LensContext) error
+	End(ctx *LensContext, left []byte) error
+	EnterRoot(ctx *LensContext, n int) error
+	LeaveRoot(ctx *LensContext, n int) error
+
+	Str(ctx *LensContext, bts []byte, str string) error
+	Int(ctx *LensContext, bts []byte, i int64) error
+	Uint(ctx *LensContext, bts []byte, u uint64) error
+	Bin(ctx *LensContext, bts []byte, bin []byte) error
+	Float32(ctx *LensContext, bts []byte, f float32) error
+	Float64(ctx *LensContext, bts []byte, f float64) error
+	Bool(ctx *LensContext, bts []byte, b bool) error
+	Nil(ctx *LensContext, prefix byte) error
+
+	EnterArray(ctx *LensContext, prefix byte, cnt int) error
+	EnterArrayElem(ctx *LensContext, n, cnt int) error
+	LeaveArrayElem(ctx *LensContext, n, cnt int) error
+	LeaveArray(ctx *LensContext, prefix byte, cnt int, bts []byte) error
+
+	EnterMap(ctx *LensContext, prefix byte, cnt int) error
+	EnterMapKey(ctx *LensContext, n, cnt int) error
+	LeaveMapKey(ctx *LensContext, n, cnt int) error
+	EnterMapElem(ctx *LensContext, n, cnt int) error
+	LeaveMapElem(ctx *LensContext, n, cnt int) error
+	LeaveMap(ctx *LensContext, prefix byte, cnt int, bts []byte) error
+
+	Extension(ctx *LensContext, bts []byte) error
+}
+
+// StreamHandler can be implemented by a Handler to receive large Str and Bin
+// payloads as a stream when walking a reader, as Visitor.StrStream and
+// Visitor.BinStream do. It is not part of Handler, as a no-op default would
+// hide those payloads from Str and Bin.
+type StreamHandler interface {
+	StrStream(ctx *LensContext, prefix byte, size int, rdr io.Reader) error
+	BinStream(ctx *LensContext, prefix byte, size int, rdr io.Reader) error
+}
+
+// BaseHandler implements every Handler method as a no-op. Embed it in a
+// Handler so only the interesting methods need to be written.
+type BaseHandler struct{}
+
+var _ Handler = BaseHandler{}
+
+func (BaseHandler) Begin(ctx *LensContext) error                            { return nil }
+func (BaseHandler) End(ctx *LensContext, left []byte) error                 { return nil }
+func (BaseHandler) EnterRoot(ctx *LensContext, n int) error                 { return nil }
+func (BaseHandler) LeaveRoot(ctx *LensContext, n int) error                 { return nil }
+func (BaseHandler) Str(ctx *LensContext, bts []byte, str string) error      { return nil }
+func (BaseHandler) Int(ctx *LensContext, bts []byte, i int64) error         { return nil }
+func (BaseHandler) Uint(ctx *LensContext, bts []byte, u uint64) error       { return nil }
+func (BaseHandler) Bin(ctx *LensContext, bts []byte, bin []byte) error      { return nil }
+func (BaseHandler) Float32(ctx *LensContext, bts []byte, f float32) error   { return nil }
+func (BaseHandler) Float64(ctx *LensContext, bts []byte, f float64) error   { return nil }
+func (BaseHandler) Bool(ctx *LensContext, bts []byte, b bool) error         { return nil }
+func (BaseHandler) Nil(ctx *LensContext, prefix byte) error                 { return nil }
+func (BaseHandler) EnterArray(ctx *LensContext, prefix byte, cnt int) error { return nil }
+func (BaseHandler) EnterArrayElem(ctx *LensContext, n, cnt int) error       { return nil }
+func (BaseHandler) LeaveArrayElem(ctx *LensContext, n, cnt int) error       { return nil }
+func (BaseHandler) EnterMap(ctx *LensContext, prefix byte, cnt int) error   { return nil }
+func (BaseHandler) EnterMapKey(ctx *LensContext, n, cnt int) error          { return nil }
+func (BaseHandler) LeaveMapKey(ctx *LensContext, n, cnt int) error          { return nil }
+func (BaseHandler) EnterMapElem(ctx *LensContext, n, cnt int) error         { return nil }
+func (BaseHandler) LeaveMapElem(ctx *LensContext, n, cnt int) error         { return nil }
+func (BaseHandler) Extension(ctx *LensContext, bts []byte) error            { return nil }
+
+func (BaseHandler) LeaveArray(ctx *LensContext, prefix byte, cnt int, bts []byte) error {
+	return nil
+}
+
+func (BaseHandler) LeaveMap(ctx *LensContext, prefix byte, cnt int, bts []byte) error {
+	return nil
+}
+
+// NewHandlerVisitor returns a Visitor that calls the methods of h.
+func NewHandlerVisitor(h Handler) *Visitor {
+	v := &Visitor{
+		Begin:     h.Begin,
+		End:       h.End,
+		EnterRoot: h.EnterRoot,
+		LeaveRoot: h.LeaveRoot,
+
+		Str:     h.Str,
+		Int:     h.Int,
+		Uint:    h.Uint,
+		Bin:     h.Bin,
+		Float32: h.Float32,
+		Float64: h.Float64,
+		Bool:    h.Bool,
+		Nil:     h.Nil,
+
+		EnterArray:     h.EnterArray,
+		EnterArrayElem: h.EnterArrayElem,
+		LeaveArrayElem: h.LeaveArrayElem,
+		LeaveArray:     h.LeaveArray,
+
+		EnterMap:     h.EnterMap,
+		EnterMapKey:  h.EnterMapKey,
+		LeaveMapKey:  h.LeaveMapKey,
+		EnterMapElem: h.EnterMapElem,
+		LeaveMapElem: h.LeaveMapElem,
+		LeaveMap:     h.LeaveMap,
+
+		Extension: h.Extension,
+	}
+	if sh, ok := h.(StreamHandler); ok {
+		v.StrStream = sh.StrStream
+		v.BinStream = sh.BinStream
+	}
+	return v
+}
@@ -0,0 +1,299 @@
+package msgplens
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Hexdump renders msgpack as hexdump -C style rows of 16 bytes. The bytes of
+// each object are marked out, and each row is annotated with the path, prefix
+// name and type of every object that starts in it.
+//
+// With color, each object's header and payload bytes are shown in alternating
+// bands of color. Without color, each object starts with a '[', and a '|'
+// separates its header from its payload.
+//
+// Each row is written as soon as all of its bytes have been walked, so only
+// the current row and object are held in memory. The last row is written at
+// the end of the walk; if the walk fails, call Flush to write the rows of
+// the objects walked before the failure.
+type Hexdump struct {
+	vis   *Visitor
+	w     *bufio.Writer
+	theme Theme
+	color bool
+
+	// row is the offset of the first row that hasn't been written, and data
+	// holds the bytes walked from there on. spans holds the objects that
+	// end after row, and next indexes the first of those that hasn't been
+	// annotated.
+	row    int
+	data   []byte
+	spans  []hexSpan
+	next   int
+	nspans int
+
+	// extra is the offset of any bytes found after the object, or -1.
+	extra int
+
+	AllowExtra bool
+}
+
+// hexSpan is an object's header, or in the case of arrays and maps only
+// their header. n is the index of the span in the input.
+type hexSpan struct {
+	n      int
+	pos    int
+	header int
+	size   int
+	prefix byte
+	path   Path
+}
+
+// NewHexdump returns a Hexdump that writes to out. Only the Color and Theme
+// fields of opts are used.
+func NewHexdump(out io.Writer, opts PrinterOptions) *Hexdump {
+	h := &Hexdump{w: bufio.NewWriter(out), extra: -1}
+	if opts.Color.enabled(out) {
+		h.color = true
+		h.theme = ThemeDark
+		if opts.Theme != nil {
+			h.theme = *opts.Theme
+		}
+	}
+
+	scalar := func(ctx *LensContext, bts []byte) error {
+		header := 1
+		if typ := getType(bts[0]); typ == StrType || typ == BinType || typ == ExtensionType {
+			header = headerSize(bts[0])
+		}
+		h.add(ctx, bts, header)
+		return nil
+	}
+	h.vis = &Visitor{
+		Str:       func(ctx *LensContext, bts []byte, str string) error { return scalar(ctx, bts) },
+		Bin:       func(ctx *LensContext, bts []byte, data []byte) error { return scalar(ctx, bts) },
+		Int:       func(ctx *LensContext, bts []byte, data int64) error { return scalar(ctx, bts) },
+		Uint:      func(ctx *LensContext, bts []byte, data uint64) error { return scalar(ctx, bts) },
+		Float32:   func(ctx *LensContext, bts []byte, data float32) error { return scalar(ctx, bts) },
+		Float64:   func(ctx *LensContext, bts []byte, data float64) error { return scalar(ctx, bts) },
+		Bool:      func(ctx *LensContext, bts []byte, data bool) error { return scalar(ctx, bts) },
+		Extension: func(ctx *LensContext, bts []byte) error { return scalar(ctx, bts) },
+		Nil: func(ctx *LensContext, prefix byte) error {
+			h.add(ctx, []byte{prefix}, 1)
+			return nil
+		},
+
+		StrStream: func(ctx *LensContext, prefix byte, size int, rdr io.Reader) error {
+			var b [5]byte
+			hdr, err := writeStringHeader(prefix, b[:], uint32(size))
+			if err != nil {
+				return err
+			}
+			return h.stream(ctx, hdr, size, rdr)
+		},
+
+		BinStream: func(ctx *LensContext, prefix byte, size int, rdr io.Reader) error {
+			var b [5]byte
+			hdr, err := writeBinHeader(prefix, b[:], uint32(size))
+			if err != nil {
+				return err
+			}
+			return h.stream(ctx, hdr, size, rdr)
+		},
+
+		EnterArray: func(ctx *LensContext, prefix byte, cnt int) error {
+			var b [5]byte
+			hdr, err := writeArrayHeader(prefix, b[:], uint32(cnt))
+			if err != nil {
+				return err
+			}
+			h.add(ctx, hdr, len(hdr))
+			return nil
+		},
+
+		EnterMap: func(ctx *LensContext, prefix byte, cnt int) error {
+			var b [5]byte
+			hdr, err := writeMapHeader(prefix, b[:], uint32(cnt))
+			if err != nil {
+				return err
+			}
+			h.add(ctx, hdr, len(hdr))
+			return nil
+		},
+
+		End: func(ctx *LensContext, left []byte) (err error) {
+			if len(left) > 0 {
+				h.extra = ctx.src.pos() - len(left)
+				h.feed(h.extra, left)
+			}
+			if len(left) > 0 && !h.AllowExtra {
+				err = fmt.Errorf("%d bytes found at end of input", len(left))
+			}
+			if ferr := h.Flush(); err == nil {
+				err = ferr
+			}
+			return err
+		},
+	}
+	return h
+}
+
+func (h *Hexdump) Visitor() *Visitor {
+	return h.vis
+}
+
+// Flush writes the last row, even if it is incomplete, and flushes the
+// output. It is called at the end of the walk.
+func (h *Hexdump) Flush() error {
+	h.writeRows(true)
+	return h.w.Flush()
+}
+
+// add adds the span of an object of which the first header bytes of bts are
+// its header.
+func (h *Hexdump) add(ctx *LensContext, bts []byte, header int) {
+	h.addSpan(ctx, bts[0], header, len(bts))
+	h.feed(ctx.Pos(), bts)
+}
+
+func (h *Hexdump) addSpan(ctx *LensContext, prefix byte, header, size int) {
+	h.spans = append(h.spans, hexSpan{
+		n:      h.nspans,
+		pos:    ctx.Pos(),
+		header: header,
+		size:   size,
+		prefix: prefix,
+		path:   ctx.Path(),
+	})
+	h.nspans++
+}
+
+// stream adds the span of a Str or Bin whose payload is read from rdr.
+func (h *Hexdump) stream(ctx *LensContext, hdr []byte, size int, rdr io.Reader) error {
+	h.addSpan(ctx, hdr[0], len(hdr), len(hdr)+size)
+	pos := ctx.Pos()
+	h.feed(pos, hdr)
+	pos += len(hdr)
+
+	var buf [4096]byte
+	for {
+		n, err := rdr.Read(buf[:])
+		h.feed(pos, buf[:n])
+		pos += n
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// feed adds the bytes found at offset pos, and writes any rows they
+// complete. Objects are visited in order, so the bytes of each one follow on
+// from the last.
+func (h *Hexdump) feed(pos int, bts []byte) {
+	h.data = append(h.data[:pos-h.row], bts...)
+	h.writeRows(false)
+}
+
+// writeRows writes every complete row, and the last incomplete one if all
+// is set.
+func (h *Hexdump) writeRows(all bool) {
+	for len(h.data) >= 16 || (all && len(h.data) > 0) {
+		n := len(h.data)
+		if n > 16 {
+			n = 16
+		}
+		h.writeRow(h.data[:n])
+		h.data = h.data[:copy(h.data, h.data[n:])]
+		h.row += 16
+
+		// Spans are in order and don't overlap, so those that end before the
+		// next row are finished with:
+		done := 0
+		for done < h.next && h.spans[done].pos+h.spans[done].size <= h.row {
+			done++
+		}
+		h.spans = h.spans[:copy(h.spans, h.spans[done:])]
+		h.next -= done
+	}
+}
+
+// writeRow writes the row of bts found at h.row.
+func (h *Hexdump) writeRow(bts []byte) {
+	row := h.row
+	h.w.WriteString(color(h.theme.AttrName, fmt.Sprintf("%08x ", row)))
+
+	var ascii strings.Builder
+	o := 0
+	for j := 0; j < 16; j++ {
+		if j == 8 {
+			h.w.WriteByte(' ')
+		}
+		if j >= len(bts) {
+			h.w.WriteString("   ")
+			continue
+		}
+
+		i := row + j
+		for o < len(h.spans) && h.spans[o].pos+h.spans[o].size <= i {
+			o++
+		}
+		sep, sgr := byte(' '), h.theme.Error
+		if o < len(h.spans) && h.spans[o].pos <= i {
+			s := &h.spans[o]
+			inHeader := i < s.pos+s.header
+			if !h.color && i == s.pos {
+				sep = '['
+			} else if !h.color && i == s.pos+s.header {
+				sep = '|'
+			}
+			sgr = h.band(s.n, inHeader)
+		}
+		h.w.WriteByte(sep)
+		h.w.WriteString(color(sgr, fmt.Sprintf("%02x", bts[j])))
+
+		if b := bts[j]; b >= 0x20 && b < 0x7f {
+			ascii.WriteByte(b)
+		} else {
+			ascii.WriteByte('.')
+		}
+	}
+	h.w.WriteString("  |" + ascii.String() + "|")
+
+	// Annotate the objects that start in this row:
+	var notes []string
+	for ; h.next < len(h.spans) && h.spans[h.next].pos < row+16; h.next++ {
+		s := &h.spans[h.next]
+		note := color(h.theme.Type, prefixName(s.prefix)) + " " + getType(s.prefix).String()
+		if path := s.path.String(); path != "" {
+			note = color(h.theme.AttrValue, path) + " " + note
+		}
+		notes = append(notes, note)
+	}
+	if h.extra >= row && h.extra < row+16 {
+		notes = append(notes, color(h.theme.Error, fmt.Sprintf("%d bytes remaining", h.row+len(h.data)-h.extra)))
+	}
+	if len(notes) > 0 {
+		h.w.WriteString("  " + strings.Join(notes, ", "))
+	}
+	h.w.WriteByte('\n')
+}
+
+// band returns the color of a header or payload byte of span i. Consecutive
+// spans alternate between two bands so they can be told apart.
+func (h *Hexdump) band(i int, header bool) string {
+	switch {
+	case i%2 == 0 && header:
+		return h.theme.Prefix
+	case i%2 == 0:
+		return h.theme.String
+	case header:
+		return h.theme.KeyIndex
+	default:
+		return h.theme.Int
+	}
+}
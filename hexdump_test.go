@@ -0,0 +1,69 @@
+package msgplens
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHexdump(t *testing.T) {
+	var out bytes.Buffer
+	h := NewHexdump(&out, PrinterOptions{})
+	h.AllowExtra = true
+	if err := WalkBytes(h, append(testObject, 0x01)); err != nil {
+		t.Fatal(err)
+	}
+	exp := "" +
+		"00000000 [82[a1|61[95[01[ff[a3|66  6f 6f[c3[c0[a1|62[cb|3f  |..a....foo...b.?|  Fixmap map, /(key 0) Fixstr str, /a Fixarray array, /a/0 Fixint int, /a/1 FixintNeg int, /a/2 Fixstr str, /a/3 True bool, /a/4 Nil nil, /(key 1) Fixstr str, /b Float64 float64\n" +
+		"00000010  f8 00 00 00 00 00 00 01                           |........|  1 bytes remaining\n"
+	if out.String() != exp {
+		t.Fatalf("\n%s\n!=\n%s", out.String(), exp)
+	}
+}
+
+func TestHexdumpStreams(t *testing.T) {
+	// [bin(100000 bytes), 1], so the Bin is streamed when walking a reader:
+	in := []byte{0x92, Bin32, 0x00, 0x01, 0x86, 0xa0}
+	in = append(in, make([]byte, 100000)...)
+	in = append(in, 0x01)
+
+	var bout, rout bytes.Buffer
+	if err := WalkBytes(NewHexdump(&bout, PrinterOptions{}), in); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rows are written before the walk ends:
+	var early int
+	check := &Visitor{Int: func(ctx *LensContext, bts []byte, i int64) error {
+		early = rout.Len()
+		return nil
+	}}
+	if err := WalkReader(MultiVisitor(NewHexdump(&rout, PrinterOptions{}), check), bytes.NewReader(in)); err != nil {
+		t.Fatal(err)
+	}
+	if rout.String() != bout.String() {
+		t.Fatal("reader output differs from bytes output")
+	}
+	if early == 0 {
+		t.Fatal("nothing written before the end of the walk")
+	}
+}
+
+func TestHexdumpWalkError(t *testing.T) {
+	// [1, 2, <Str8 of 10 bytes, truncated to 3>]
+	in := []byte{0x93, 0x01, 0x02, Str8, 10, 'b', 'o', 'b'}
+	var out bytes.Buffer
+	h := NewHexdump(&out, PrinterOptions{})
+	if err := WalkReader(h, bytes.NewReader(in)); err == nil {
+		t.Fatal("expected error")
+	}
+	if out.Len() != 0 {
+		t.Fatalf("unexpected output before Flush:\n%s", out.String())
+	}
+	if err := h.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	exp := "00000000 [93[01[02                                          |...|  Fixarray array, /0 Fixint int, /1 Fixint int\n"
+	if out.String() != exp {
+		t.Fatalf("\n%q\n!=\n%q", out.String(), exp)
+	}
+}
@@ -1,75 +1,645 @@
 package msgplens
 
 import (
+	"bufio"
 	"bytes"
-	"reflect"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
 	"strconv"
-	"unsafe"
+	"strings"
 )
 
-// JSONEncoder exports a msgpack object as a lossy JSON equivalent.
+// JSONOptions controls the output of a JSONEncoder.
+type JSONOptions struct {
+	// Indent is the number of spaces each level of arrays and maps is
+	// indented by. If zero, output is compact.
+	Indent int
+
+	// SortKeys writes the entries of each map ordered by their encoded keys
+	// rather than in input order, so that the output of equivalent objects
+	// can be diffed. Each map's entries are buffered until the end of the map.
+	SortKeys bool
+
+	// Color controls whether output is colored. The zero value, ColorAuto,
+	// colors output only if it is written to a terminal and the NO_COLOR
+	// environment variable is not set; output from NewJSONEncoder is never
+	// colored unless Color is ColorAlways.
+	Color ColorMode
+
+	// Theme is the palette used for colored output. If nil, ThemeDark is
+	// used. Keys use KeyType, null and booleans use Type and decoded
+	// extensions use Ext.
+	Theme *Theme
+
+	// Keys controls how map keys that are not strings are written. The zero
+	// value, JSONKeyString, writes them as strings.
+	Keys JSONKeyPolicy
+
+	// Bin controls how Bin objects, and the data of extensions without a
+	// decoder, are written. The zero value, JSONBinBase64, writes them as
+	// base64 strings.
+	Bin JSONBinPolicy
+
+	// Ext controls how extensions without a decoder in the JSONEncoder's
+	// Extensions are written. The zero value, JSONExtObject, writes them as
+	// objects.
+	Ext JSONExtPolicy
+
+	// NonFinite controls how NaN and infinite floats are written. The zero
+	// value, JSONNonFiniteError, fails the walk.
+	NonFinite JSONNonFinitePolicy
+}
+
+// JSONKeyPolicy controls how a JSONEncoder writes map keys that are not
+// strings.
+type JSONKeyPolicy int
+
+const (
+	// JSONKeyString writes the JSON encoding of the key as a string, so the
+	// int key 1 is written as "1" and the array key [1,2] as "[1,2]".
+	JSONKeyString JSONKeyPolicy = iota
+
+	// JSONKeyError fails the walk.
+	JSONKeyError
+
+	// JSONKeyPairs writes maps with keys that aren't strings as an array of
+	// [key, value] pairs. Maps are buffered until their last entry to find
+	// out which form to use.
+	JSONKeyPairs
+)
+
+// JSONBinPolicy controls how a JSONEncoder writes binary data.
+type JSONBinPolicy int
+
+const (
+	// JSONBinBase64 writes a string using encoding/base64.StdEncoding.
+	JSONBinBase64 JSONBinPolicy = iota
+
+	// JSONBinHex writes a string of lower case hex.
+	JSONBinHex
+
+	// JSONBinArray writes an array of ints, one per byte, on a single line.
+	JSONBinArray
+)
+
+// JSONExtPolicy controls how a JSONEncoder writes extensions it cannot
+// decode.
+type JSONExtPolicy int
+
+const (
+	// JSONExtObject writes an object such as {"type":5,"data":"eQ=="}, with
+	// data written according to the Bin policy.
+	JSONExtObject JSONExtPolicy = iota
+
+	// JSONExtDrop leaves the extension out. Map entries whose value is
+	// dropped are left out too. An extension that is a map key or the top
+	// level object is written as null instead.
+	JSONExtDrop
+)
+
+// JSONNonFinitePolicy controls how a JSONEncoder writes NaN and infinite
+// floats, which JSON can't represent.
+type JSONNonFinitePolicy int
+
+const (
+	// JSONNonFiniteError fails the walk.
+	JSONNonFiniteError JSONNonFinitePolicy = iota
+
+	// JSONNonFiniteNull writes null.
+	JSONNonFiniteNull
+
+	// JSONNonFiniteString writes "NaN", "Infinity" or "-Infinity".
+	JSONNonFiniteString
+)
+
+// JSONEncoder exports a msgpack object as a lossy JSON equivalent. When every
+// object in a stream is walked, each is written on its own line, wrapped in
+// an object that numbers it and gives its offset, such as
+// {"root":1,"pos":12,"value":[1,2]}.
 type JSONEncoder struct {
-	buf          *bytes.Buffer
+	buf          jsonWriter
 	vis          *Visitor
 	floatScratch []byte
+	opts         JSONOptions
+	theme        Theme
+
+	// stack holds the arrays and maps being written. base is the depth of
+	// the enclosing document for an encoder writing an extension's contents.
+	stack []jsonFrame
+	base  int
+
+	// keyDepth counts the map keys being written. Keys are written without
+	// color or indentation, so they can be turned into strings.
+	keyDepth int
+
+	// stream and out are set by NewJSONStreamEncoder. out records the first
+	// error writing to the underlying io.Writer.
+	stream *bufio.Writer
+	out    *errWriter
+
+	// Extensions decodes extension objects. If nil, DefaultExtRegistry is
+	// used. Extensions without a decoder are written according to the Ext
+	// policy.
+	Extensions *ExtRegistry
+}
+
+// jsonFrame is an array or map being written. Nothing is written for an
+// element until its value begins, so that dropped values leave no trace.
+type jsonFrame struct {
+	isMap   bool
+	root    bool // The wrapper of a top level object walked from a stream
+	pending bool // An element has begun, but nothing has been written for it
+	n       int  // Elements written
+
+	// Each map key is written to key, then kept in keyText once resolved.
+	// parent is the output of the map itself while its key is written, or
+	// while its values are buffered.
+	parent  jsonWriter
+	key     *bytes.Buffer
+	keyText []byte
+	keyStr  bool
+
+	// With SortKeys or JSONKeyPairs, each value is written to val, and each
+	// entry collected in entries until the end of the map.
+	val     *bytes.Buffer
+	entries []jsonEntry
+}
+
+type jsonEntry struct {
+	key, val []byte
+	keyStr   bool
 }
 
 func (j *JSONEncoder) Visitor() *Visitor {
 	return j.vis
 }
 
+// jsonWriter is implemented by both bytes.Buffer and bufio.Writer.
+type jsonWriter interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
+}
+
+// NewJSONEncoder returns a JSONEncoder that builds its output in memory, to
+// be retrieved with String once the walk is done.
 func NewJSONEncoder() *JSONEncoder {
-	je := &JSONEncoder{}
-	je.buf = &bytes.Buffer{}
+	return NewJSONEncoderWithOptions(JSONOptions{})
+}
+
+// NewJSONEncoderWithOptions is NewJSONEncoder with options.
+func NewJSONEncoderWithOptions(opts JSONOptions) *JSONEncoder {
+	return newJSONEncoder(&bytes.Buffer{}, opts, opts.Color == ColorAlways)
+}
+
+// NewJSONStreamEncoder returns a JSONEncoder that writes its output to w as
+// the walk progresses. Output is buffered, and flushed whenever the buffer
+// fills, after each object when every object in a stream is walked, and at
+// the end of the walk. The first error writing to w is returned by the walk.
+func NewJSONStreamEncoder(w io.Writer) *JSONEncoder {
+	return NewJSONStreamEncoderWithOptions(w, JSONOptions{})
+}
+
+// NewJSONStreamEncoderWithOptions is NewJSONStreamEncoder with options.
+func NewJSONStreamEncoderWithOptions(w io.Writer, opts JSONOptions) *JSONEncoder {
+	out := &errWriter{w: w}
+	stream := bufio.NewWriter(out)
+	je := newJSONEncoder(stream, opts, opts.Color.enabled(w))
+	je.stream, je.out = stream, out
+	return je
+}
+
+func newJSONEncoder(buf jsonWriter, opts JSONOptions, color bool) *JSONEncoder {
+	je := &JSONEncoder{opts: opts}
+	je.buf = buf
+	if color {
+		je.theme = ThemeDark
+		if opts.Theme != nil {
+			je.theme = *opts.Theme
+		}
+	}
 	je.vis = &Visitor{
-		Nil: func(ctx *LensContext, prefix byte) error { je.buf.WriteString("null"); return nil },
-		Str: func(ctx *LensContext, bts []byte, str string) error { je.writeJSONString(str); return nil },
+		EnterRoot: func(ctx *LensContext, n int) error {
+			if !ctx.multi {
+				return nil
+			}
+			je.buf.WriteByte('{')
+			je.stack = append(je.stack, jsonFrame{root: true})
+			je.newline()
+			je.writeKey([]byte(`"root"`))
+			je.write(je.theme.Int, strconv.Itoa(n))
+			je.buf.WriteByte(',')
+			je.newline()
+			je.writeKey([]byte(`"pos"`))
+			je.write(je.theme.Int, strconv.Itoa(ctx.RootPos()))
+			je.buf.WriteByte(',')
+			je.newline()
+			je.writeKey([]byte(`"value"`))
+			return je.err()
+		},
+
+		LeaveRoot: func(ctx *LensContext, n int) error {
+			if ctx.multi {
+				je.pop()
+				je.newline()
+				je.buf.WriteString("}\n")
+				return je.Flush()
+			}
+			return je.err()
+		},
+
+		End: func(ctx *LensContext, left []byte) error {
+			return je.Flush()
+		},
+
+		Nil: func(ctx *LensContext, prefix byte) error {
+			je.open()
+			je.write(je.theme.Type, "null")
+			return je.err()
+		},
+		Str: func(ctx *LensContext, bts []byte, str string) error {
+			je.open()
+			je.writeString(je.theme.String, str)
+			return je.err()
+		},
 		Int: func(ctx *LensContext, bts []byte, data int64) error {
-			je.buf.WriteString(strconv.FormatInt(data, 10))
-			return nil
+			je.open()
+			je.write(je.theme.Int, strconv.FormatInt(data, 10))
+			return je.err()
 		},
 		Uint: func(ctx *LensContext, bts []byte, data uint64) error {
-			je.buf.WriteString(strconv.FormatUint(data, 10))
-			return nil
+			je.open()
+			je.write(je.theme.Int, strconv.FormatUint(data, 10))
+			return je.err()
+		},
+		Bin: func(ctx *LensContext, bts []byte, data []byte) error {
+			je.open()
+			je.writeBin(data)
+			return je.err()
 		},
-		Bin:       func(ctx *LensContext, bts []byte, data []byte) error { je.writeBin(data); return nil },
 		Float64:   func(ctx *LensContext, bts []byte, data float64) error { return je.writeJSONFloat(data) },
 		Float32:   func(ctx *LensContext, bts []byte, data float32) error { return je.writeJSONFloat(float64(data)) },
-		Extension: func(ctx *LensContext, bts []byte) error { je.writeBin(bts); return nil },
+		Extension: func(ctx *LensContext, bts []byte) error { return je.writeExt(ctx, bts) },
 		Bool: func(ctx *LensContext, bts []byte, data bool) error {
+			je.open()
 			if data {
-				je.buf.WriteString("true")
+				je.write(je.theme.Type, "true")
 			} else {
-				je.buf.WriteString("false")
+				je.write(je.theme.Type, "false")
 			}
+			return je.err()
+		},
+
+		EnterArray: func(ctx *LensContext, prefix byte, cnt int) error {
+			je.open()
+			je.buf.WriteByte('[')
+			je.stack = append(je.stack, jsonFrame{})
+			return je.err()
+		},
+
+		EnterArrayElem: func(ctx *LensContext, n, cnt int) error {
+			je.stack[len(je.stack)-1].pending = true
 			return nil
 		},
 
-		EnterArray:  func(ctx *LensContext, prefix byte, cnt int) error { je.buf.WriteByte('['); return nil },
-		LeaveArray:  func(ctx *LensContext, prefix byte, cnt int, bts []byte) error { je.buf.WriteByte(']'); return nil },
-		EnterMap:    func(ctx *LensContext, prefix byte, cnt int) error { je.buf.WriteByte('{'); return nil },
-		LeaveMapKey: func(ctx *LensContext, n, cnt int) error { je.buf.WriteByte(':'); return nil },
-		LeaveMap:    func(ctx *LensContext, prefix byte, cnt int, bts []byte) error { je.buf.WriteByte('}'); return nil },
+		LeaveArray: func(ctx *LensContext, prefix byte, cnt int, bts []byte) error {
+			f := je.pop()
+			if f.n > 0 {
+				je.newline()
+			}
+			je.buf.WriteByte(']')
+			return je.err()
+		},
 
-		LeaveArrayElem: func(ctx *LensContext, n, cnt int) error {
-			if n < cnt-1 {
-				je.buf.WriteByte(',')
+		EnterMap: func(ctx *LensContext, prefix byte, cnt int) error {
+			je.open()
+			if !je.buffered() {
+				je.buf.WriteByte('{')
 			}
+			je.stack = append(je.stack, jsonFrame{isMap: true})
+			return je.err()
+		},
+
+		EnterMapKey: func(ctx *LensContext, n, cnt int) error {
+			f := &je.stack[len(je.stack)-1]
+			f.pending = false
+			f.parent = je.buf
+			if f.key == nil {
+				f.key = &bytes.Buffer{}
+			}
+			f.key.Reset()
+			je.buf = f.key
+			je.keyDepth++
+			return nil
+		},
+
+		LeaveMapKey: func(ctx *LensContext, n, cnt int) error {
+			je.keyDepth--
+			f := &je.stack[len(je.stack)-1]
+			key := f.key.Bytes()
+			f.keyStr = len(key) > 0 && key[0] == '"'
+			if !f.keyStr {
+				switch je.opts.Keys {
+				case JSONKeyError:
+					return fmt.Errorf("unsupported map key %s at %q", key, ctx.Path())
+				case JSONKeyString:
+					var quoted bytes.Buffer
+					je.buf = &quoted
+					je.writeJSONString(string(key))
+					key, f.keyStr = quoted.Bytes(), true
+				}
+			}
+			f.keyText = append(f.keyText[:0], key...)
+			if je.buffered() {
+				f.val = &bytes.Buffer{}
+				je.buf = f.val
+			} else {
+				je.buf = f.parent
+			}
+			f.pending = true
 			return nil
 		},
 
 		LeaveMapElem: func(ctx *LensContext, n, cnt int) error {
-			if n < cnt-1 {
-				je.buf.WriteByte(',')
+			if je.buffered() {
+				f := &je.stack[len(je.stack)-1]
+				je.buf = f.parent
+				if !f.pending {
+					key := append([]byte{}, f.keyText...)
+					f.entries = append(f.entries, jsonEntry{key: key, val: f.val.Bytes(), keyStr: f.keyStr})
+				}
 			}
 			return nil
 		},
+
+		LeaveMap: func(ctx *LensContext, prefix byte, cnt int, bts []byte) error {
+			if je.buffered() {
+				return je.writeEntries()
+			}
+			f := je.pop()
+			if f.n > 0 {
+				je.newline()
+			}
+			je.buf.WriteByte('}')
+			return je.err()
+		},
 	}
 	return je
 }
 
+// buffered reports whether the entries of maps are collected until the end
+// of the map, rather than written as they are walked.
+func (j *JSONEncoder) buffered() bool {
+	return j.opts.SortKeys || j.opts.Keys == JSONKeyPairs
+}
+
+// open writes whatever precedes a value: the separator and indentation of
+// an array element or map entry, and the key of a map entry.
+func (j *JSONEncoder) open() {
+	if len(j.stack) == 0 {
+		return
+	}
+	f := &j.stack[len(j.stack)-1]
+	if !f.pending {
+		return
+	}
+	f.pending = false
+	if f.isMap && j.buffered() {
+		return
+	}
+	if f.n > 0 {
+		j.buf.WriteByte(',')
+	}
+	j.newline()
+	f.n++
+	if f.isMap {
+		j.writeKey(f.keyText)
+	}
+}
+
+// writeKey writes a resolved map key and the colon after it. Like newline,
+// it doesn't indent inside a map key, so keys don't depend on Indent.
+func (j *JSONEncoder) writeKey(key []byte) {
+	j.write(j.theme.KeyType, string(key))
+	j.buf.WriteByte(':')
+	if j.opts.Indent > 0 && j.keyDepth == 0 {
+		j.buf.WriteByte(' ')
+	}
+}
+
+// writeEntries writes the buffered entries of the map at the top of the
+// stack, as an object or, if it has keys that aren't strings, an array of
+// pairs.
+func (j *JSONEncoder) writeEntries() error {
+	entries := j.stack[len(j.stack)-1].entries
+	if j.opts.SortKeys {
+		sort.SliceStable(entries, func(a, b int) bool {
+			return bytes.Compare(entries[a].key, entries[b].key) < 0
+		})
+	}
+
+	pairs := false
+	for _, e := range entries {
+		pairs = pairs || !e.keyStr
+	}
+	open, close := byte('{'), byte('}')
+	if pairs {
+		open, close = '[', ']'
+	}
+
+	j.buf.WriteByte(open)
+	for i, e := range entries {
+		if i > 0 {
+			j.buf.WriteByte(',')
+		}
+		j.newline()
+		if !pairs {
+			j.writeKey(e.key)
+			j.buf.Write(e.val)
+			continue
+		}
+
+		// Each pair is nested one level deeper than the entry was written.
+		j.buf.WriteByte('[')
+		j.stack = append(j.stack, jsonFrame{})
+		j.newline()
+		j.write(j.theme.KeyType, string(e.key))
+		j.buf.WriteByte(',')
+		j.newline()
+		if j.opts.Indent > 0 {
+			j.buf.Write(bytes.ReplaceAll(e.val, []byte("\n"), []byte("\n"+strings.Repeat(" ", j.opts.Indent))))
+		} else {
+			j.buf.Write(e.val)
+		}
+		j.pop()
+		j.newline()
+		j.buf.WriteByte(']')
+	}
+
+	j.pop()
+	if len(entries) > 0 {
+		j.newline()
+	}
+	j.buf.WriteByte(close)
+	return j.err()
+}
+
+func (j *JSONEncoder) pop() jsonFrame {
+	f := j.stack[len(j.stack)-1]
+	j.stack = j.stack[:len(j.stack)-1]
+	return f
+}
+
+// color returns sgr, or nothing while a map key is being written.
+func (j *JSONEncoder) color(sgr string) string {
+	if j.keyDepth > 0 {
+		return ""
+	}
+	return sgr
+}
+
+// write writes s, colored with sgr.
+func (j *JSONEncoder) write(sgr string, s string) {
+	sgr = j.color(sgr)
+	j.buf.WriteString(colorStart(sgr))
+	j.buf.WriteString(s)
+	j.buf.WriteString(colorEnd(sgr))
+}
+
+// writeString writes s as a JSON string, colored with sgr.
+func (j *JSONEncoder) writeString(sgr string, s string) {
+	sgr = j.color(sgr)
+	j.buf.WriteString(colorStart(sgr))
+	j.writeJSONString(s)
+	j.buf.WriteString(colorEnd(sgr))
+}
+
+// newline starts a new line indented to the current depth, if the output is
+// indented.
+func (j *JSONEncoder) newline() {
+	if j.opts.Indent <= 0 || j.keyDepth > 0 {
+		return
+	}
+	j.buf.WriteByte('\n')
+	j.buf.WriteString(j.indent())
+}
+
+func (j *JSONEncoder) indent() string {
+	return strings.Repeat(" ", j.opts.Indent*(j.base+len(j.stack)))
+}
+
 func (j *JSONEncoder) writeBin(data []byte) {
-	sh := (*reflect.SliceHeader)(unsafe.Pointer(&data))
-	str := *(*string)(unsafe.Pointer(&reflect.StringHeader{Data: sh.Data, Len: sh.Len}))
-	j.writeJSONString(str)
+	switch j.opts.Bin {
+	case JSONBinHex:
+		j.write(j.theme.String, `"`+hex.EncodeToString(data)+`"`)
+
+	case JSONBinArray:
+		j.buf.WriteByte('[')
+		for i, b := range data {
+			if i > 0 {
+				j.buf.WriteByte(',')
+			}
+			j.write(j.theme.Int, strconv.Itoa(int(b)))
+		}
+		j.buf.WriteByte(']')
+
+	default:
+		j.write(j.theme.String, `"`+base64.StdEncoding.EncodeToString(data)+`"`)
+	}
+}
+
+func (j *JSONEncoder) writeExt(ctx *LensContext, bts []byte) error {
+	v, ok := j.Extensions.decodeExt(bts)
+	if !ok && j.opts.Ext == JSONExtDrop && j.keyDepth == 0 && len(j.stack) > 0 && !j.stack[len(j.stack)-1].root {
+		return nil
+	}
+
+	j.open()
+	switch {
+	case !ok && j.opts.Ext == JSONExtDrop:
+		j.write(j.theme.Type, "null")
+
+	case !ok:
+		ext := readExtension(bts)
+		sep := ","
+		if j.opts.Indent > 0 && j.keyDepth == 0 {
+			sep = ", "
+		}
+		j.buf.WriteByte('{')
+		j.writeKey([]byte(`"type"`))
+		j.write(j.theme.Int, strconv.Itoa(int(ext.Type)))
+		j.buf.WriteString(sep)
+		j.writeKey([]byte(`"data"`))
+		j.writeBin(ext.Data)
+		j.buf.WriteByte('}')
+
+	case v.JSON != nil:
+		var out []byte
+		var err error
+		if j.opts.Indent > 0 && j.keyDepth == 0 {
+			out, err = json.MarshalIndent(v.JSON, j.indent(), strings.Repeat(" ", j.opts.Indent))
+		} else {
+			out, err = json.Marshal(v.JSON)
+		}
+		if err != nil {
+			return err
+		}
+		j.write(j.theme.Ext, string(out))
+
+	case v.Msgpack != nil:
+		sub := newJSONEncoder(j.buf, j.opts, false)
+		sub.theme = j.theme
+		sub.base = j.base + len(j.stack)
+		sub.keyDepth = j.keyDepth
+		sub.out = j.out
+		sub.Extensions = j.Extensions
+		return ctx.walkNested(sub, v.Msgpack)
+
+	default:
+		j.write(j.theme.Type, "null")
+	}
+	return j.err()
+}
+
+// err returns the first error writing to the underlying io.Writer of a
+// JSONEncoder from NewJSONStreamEncoder.
+func (j *JSONEncoder) err() error {
+	if j.out != nil {
+		return j.out.err
+	}
+	return nil
+}
+
+// Flush writes any buffered output of a JSONEncoder from
+// NewJSONStreamEncoder to its io.Writer. It does nothing for other
+// JSONEncoders.
+func (j *JSONEncoder) Flush() error {
+	if j.stream == nil {
+		return j.err()
+	}
+	if err := j.stream.Flush(); err != nil {
+		return err
+	}
+	return j.err()
+}
+
+// errWriter records the first error returned by w.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (e *errWriter) Write(b []byte) (n int, err error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	n, err = e.w.Write(b)
+	if err != nil {
+		e.err = err
+	}
+	return n, err
 }
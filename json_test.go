@@ -0,0 +1,255 @@
+package msgplens
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestJSONStreamEncoder(t *testing.T) {
+	in := append(append([]byte{}, testObject...), testObject...)
+
+	mem := NewJSONEncoder()
+	if err := WalkAllBytes(mem, in); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	enc := NewJSONStreamEncoder(&out)
+	if err := WalkAllReader(enc, bytes.NewReader(in)); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != mem.String() {
+		t.Fatalf("%q != %q", out.String(), mem.String())
+	}
+}
+
+type failWriter struct{ err error }
+
+func (f failWriter) Write(b []byte) (int, error) { return 0, f.err }
+
+func TestJSONStreamEncoderWriteError(t *testing.T) {
+	werr := errors.New("write failed")
+	err := WalkBytes(NewJSONStreamEncoder(failWriter{werr}), testObject)
+	if !errors.Is(err, werr) {
+		t.Fatalf("expected write error, found %v", err)
+	}
+
+	// The error is reported before the end of the walk once the buffer fills:
+	var calls int
+	big := append([]byte{0xdc, 0x40, 0x00}, bytes.Repeat([]byte{0xa3, 'f', 'o', 'o'}, 0x4000)...)
+	vis := MultiVisitor(NewJSONStreamEncoder(failWriter{werr}), &Visitor{
+		Str: func(ctx *LensContext, bts []byte, str string) error { calls++; return nil },
+	})
+	if err := WalkBytes(vis, big); !errors.Is(err, werr) {
+		t.Fatalf("expected write error, found %v", err)
+	}
+	if calls >= 0x4000 {
+		t.Fatalf("walk continued after write error")
+	}
+}
+
+func TestJSONEncoderOptions(t *testing.T) {
+	// {"b": [1, {}], "a": {"d": true, "c": []}}
+	in := []byte{
+		0x82,
+		0xa1, 'b', 0x92, 0x01, 0x80,
+		0xa1, 'a', 0x82, 0xa1, 'd', 0xc3, 0xa1, 'c', 0x90,
+	}
+
+	for idx, tc := range []struct {
+		opts JSONOptions
+		out  string
+	}{
+		{JSONOptions{}, `{"b":[1,{}],"a":{"d":true,"c":[]}}`},
+		{JSONOptions{SortKeys: true}, `{"a":{"c":[],"d":true},"b":[1,{}]}`},
+		{JSONOptions{Indent: 2}, "{\n  \"b\": [\n    1,\n    {}\n  ],\n  \"a\": {\n    \"d\": true,\n    \"c\": []\n  }\n}"},
+		{JSONOptions{Indent: 1, SortKeys: true}, "{\n \"a\": {\n  \"c\": [],\n  \"d\": true\n },\n \"b\": [\n  1,\n  {}\n ]\n}"},
+		{
+			JSONOptions{Color: ColorAlways, Theme: &Theme{KeyType: "1", Int: "2", Type: "3"}},
+			"{\x1b[1m\"b\"\x1b[0m:[\x1b[2m1\x1b[0m,{}],\x1b[1m\"a\"\x1b[0m:{\x1b[1m\"d\"\x1b[0m:\x1b[3mtrue\x1b[0m,\x1b[1m\"c\"\x1b[0m:[]}}",
+		},
+	} {
+		enc := NewJSONEncoderWithOptions(tc.opts)
+		if err := WalkBytes(enc, in); err != nil {
+			t.Fatal(idx, err)
+		}
+		if enc.String() != tc.out {
+			t.Fatalf("%d: %q != %q", idx, enc.String(), tc.out)
+		}
+	}
+}
+
+func TestJSONEncoderPolicies(t *testing.T) {
+	// {1: bin(0x01 0xff), "e": ext(5, "y"), "f": NaN, [1]: -Inf}
+	in := []byte{
+		0x84,
+		0x01, Bin8, 2, 0x01, 0xff,
+		0xa1, 'e', Fixext1, 5, 'y',
+		0xa1, 'f', Float64, 0x7f, 0xf8, 0, 0, 0, 0, 0, 1,
+		0x91, 0x01, Float32, 0xff, 0x80, 0, 0,
+	}
+
+	for idx, tc := range []struct {
+		opts JSONOptions
+		out  string
+	}{
+		{
+			JSONOptions{NonFinite: JSONNonFiniteNull},
+			`{"1":"Af8=","e":{"type":5,"data":"eQ=="},"f":null,"[1]":null}`,
+		},
+		{
+			JSONOptions{NonFinite: JSONNonFiniteString, Bin: JSONBinHex, Ext: JSONExtDrop},
+			`{"1":"01ff","f":"NaN","[1]":"-Infinity"}`,
+		},
+		{
+			JSONOptions{NonFinite: JSONNonFiniteNull, Bin: JSONBinArray, Keys: JSONKeyPairs},
+			`[[1,[1,255]],["e",{"type":5,"data":[121]}],["f",null],[[1],null]]`,
+		},
+		{
+			JSONOptions{NonFinite: JSONNonFiniteNull, Keys: JSONKeyPairs, Ext: JSONExtDrop, Indent: 1},
+			"[\n [\n  1,\n  \"Af8=\"\n ],\n [\n  \"f\",\n  null\n ],\n [\n  [1],\n  null\n ]\n]",
+		},
+	} {
+		enc := NewJSONEncoderWithOptions(tc.opts)
+		if err := WalkBytes(enc, in); err != nil {
+			t.Fatal(idx, err)
+		}
+		if enc.String() != tc.out {
+			t.Fatalf("%d: %q != %q", idx, enc.String(), tc.out)
+		}
+	}
+
+	// A dropped top level extension is still written, as null:
+	enc := NewJSONEncoderWithOptions(JSONOptions{Ext: JSONExtDrop})
+	if err := WalkAllBytes(enc, []byte{Fixext1, 5, 'y', 0x01}); err != nil {
+		t.Fatal(err)
+	}
+	if exp := "{\"root\":0,\"pos\":0,\"value\":null}\n{\"root\":1,\"pos\":3,\"value\":1}\n"; enc.String() != exp {
+		t.Fatalf("%q != %q", enc.String(), exp)
+	}
+
+	for _, opts := range []JSONOptions{
+		{NonFinite: JSONNonFiniteNull, Keys: JSONKeyError},
+		{},
+	} {
+		if err := WalkBytes(NewJSONEncoderWithOptions(opts), in); err == nil {
+			t.Fatalf("expected error for %+v", opts)
+		}
+	}
+
+	// The WalkError gives the path, so the message doesn't repeat it:
+	err := WalkBytes(NewJSONEncoder(), []byte{0x91, Float64, 0x7f, 0xf8, 0, 0, 0, 0, 0, 1})
+	if exp := "walk failed at position 1 (/0), prefix 0xcb Float64: unsupported value NaN"; err == nil || err.Error() != exp {
+		t.Fatalf("%v != %s", err, exp)
+	}
+
+	// A map key that is itself a map is the same whether or not the output
+	// is indented. {{1: [2]}: 3}:
+	key := []byte{0x81, 0x81, 0x01, 0x91, 0x02, 0x03}
+	for _, tc := range []struct {
+		opts JSONOptions
+		out  string
+	}{
+		{JSONOptions{}, `{"{\"1\":[2]}":3}`},
+		{JSONOptions{Indent: 2}, "{\n  \"{\\\"1\\\":[2]}\": 3\n}"},
+		{JSONOptions{Indent: 2, SortKeys: true}, "{\n  \"{\\\"1\\\":[2]}\": 3\n}"},
+	} {
+		enc := NewJSONEncoderWithOptions(tc.opts)
+		if err := WalkBytes(enc, key); err != nil {
+			t.Fatal(err)
+		}
+		if enc.String() != tc.out {
+			t.Fatalf("%q != %q", enc.String(), tc.out)
+		}
+	}
+}
+
+func TestUnmarshalJSONNumbers(t *testing.T) {
+	for idx, tc := range []struct {
+		in   string
+		opts JSONDecodeOptions
+		out  []byte
+	}{
+		{"1", JSONDecodeOptions{}, []byte{0x01}},
+		{"-33", JSONDecodeOptions{}, []byte{Int8, 0xdf}},
+		{"255", JSONDecodeOptions{}, []byte{Uint8, 0xff}},
+		{"-40000", JSONDecodeOptions{}, []byte{Int32, 0xff, 0xff, 0x63, 0xc0}},
+		{"4294967296", JSONDecodeOptions{}, []byte{Uint64, 0, 0, 0, 0x01, 0, 0, 0, 0}},
+		{"18446744073709551615", JSONDecodeOptions{}, []byte{Uint64, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"200", JSONDecodeOptions{Ints: JSONIntSigned}, []byte{Int16, 0x00, 0xc8}},
+		{"1", JSONDecodeOptions{Ints: JSONIntAlways64}, []byte{Int64, 0, 0, 0, 0, 0, 0, 0, 1}},
+		{"1.5", JSONDecodeOptions{}, []byte{Float64, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{"1.5", JSONDecodeOptions{Floats: JSONFloatSmallest}, []byte{Float32, 0x3f, 0xc0, 0, 0}},
+		{"0.1", JSONDecodeOptions{Floats: JSONFloatSmallest}, []byte{Float64, 0x3f, 0xb9, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9a}},
+		{"0.1", JSONDecodeOptions{Floats: JSONFloatAlways32}, []byte{Float32, 0x3d, 0xcc, 0xcc, 0xcd}},
+		{"18446744073709551616", JSONDecodeOptions{IntOverflowFloat: true}, []byte{Float64, 0x43, 0xf0, 0, 0, 0, 0, 0, 0}},
+	} {
+		node, err := UnmarshalJSONOptions([]byte(tc.in), tc.opts)
+		if err != nil {
+			t.Fatal(idx, err)
+		}
+		var out bytes.Buffer
+		if err := node.Msgpack(&out); err != nil {
+			t.Fatal(idx, err)
+		}
+		if !bytes.Equal(out.Bytes(), tc.out) {
+			t.Fatalf("%d: % x != % x", idx, out.Bytes(), tc.out)
+		}
+	}
+
+	for _, in := range []string{"18446744073709551616", "-9223372036854775809"} {
+		if _, err := UnmarshalJSON([]byte(in), false); err == nil {
+			t.Fatalf("expected error for %s", in)
+		}
+	}
+	if _, err := UnmarshalJSONOptions([]byte("9223372036854775808"), JSONDecodeOptions{Ints: JSONIntSigned}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestUnmarshalJSONKeyOrder(t *testing.T) {
+	in := []byte(`{"b": 1, "a": [null, {"d": true, "c": false}], "b": 2}`)
+
+	for idx, tc := range []struct {
+		opts JSONDecodeOptions
+		out  string
+	}{
+		{JSONDecodeOptions{}, `{"b":1,"a":[null,{"d":true,"c":false}],"b":2}`},
+		{JSONDecodeOptions{SortKeys: true}, `{"a":[null,{"c":false,"d":true}],"b":1,"b":2}`},
+	} {
+		node, err := UnmarshalJSONOptions(in, tc.opts)
+		if err != nil {
+			t.Fatal(idx, err)
+		}
+		var msgp bytes.Buffer
+		if err := node.Msgpack(&msgp); err != nil {
+			t.Fatal(idx, err)
+		}
+		enc := NewJSONEncoder()
+		if err := WalkBytes(enc, msgp.Bytes()); err != nil {
+			t.Fatal(idx, err)
+		}
+		if enc.String() != tc.out {
+			t.Fatalf("%d: %s != %s", idx, enc.String(), tc.out)
+		}
+	}
+
+	_, err := UnmarshalJSONOptions(in, JSONDecodeOptions{DuplicateKeys: JSONDuplicateError})
+	if err == nil || !strings.Contains(err.Error(), `duplicate key "b"`) {
+		t.Fatalf("expected duplicate key error, found %v", err)
+	}
+}
+
+func TestUnmarshalJSONSizes(t *testing.T) {
+	node, err := UnmarshalJSON([]byte(`["a", "`+strings.Repeat("b", 40)+`", true, false, null, [], {}]`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range append(NodeList{node}, node.(*ArrayNode).Children...) {
+		if c := n.common(); c.Size != headerSize(c.Prefix) {
+			t.Fatalf("%s size %d, expected %d", prefixName(c.Prefix), c.Size, headerSize(c.Prefix))
+		}
+	}
+}
@@ -6,34 +6,205 @@ import (
 	"fmt"
 	"math"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
+)
+
+// JSONDecodeOptions controls how UnmarshalJSONOptions converts JSON into
+// msgpack.
+type JSONDecodeOptions struct {
+	// Extra allows data after the JSON object.
+	Extra bool
+
+	// TimeLayout, if set, is a time.Parse layout. Strings that match it are
+	// converted to Timestamp extensions instead of msgpack strings. Use
+	// time.RFC3339Nano to reverse what JSONEncoder does with Timestamps.
+	TimeLayout string
+
+	// Ints controls the width of integers. The zero value, JSONIntMinimal,
+	// uses the smallest encoding.
+	Ints JSONIntWidth
+
+	// Floats controls the width of numbers with a fraction or exponent. The
+	// zero value, JSONFloatAlways64, encodes every one as a Float64.
+	Floats JSONFloatWidth
+
+	// IntOverflowFloat converts integers outside the range of both int64 and
+	// uint64 to floats instead of failing.
+	IntOverflowFloat bool
+
+	// SortKeys sorts the entries of each object by key. By default, entries
+	// keep the order they have in the input.
+	SortKeys bool
+
+	// DuplicateKeys controls what happens to objects that have the same key
+	// more than once. The zero value, JSONDuplicateKeep, keeps every entry.
+	DuplicateKeys JSONDuplicatePolicy
+}
+
+// JSONDuplicatePolicy controls how UnmarshalJSONOptions handles objects with
+// duplicate keys.
+type JSONDuplicatePolicy int
+
+const (
+	// JSONDuplicateKeep writes every entry to the msgpack map, duplicates
+	// included.
+	JSONDuplicateKeep JSONDuplicatePolicy = iota
+
+	// JSONDuplicateError fails with the duplicated key.
+	JSONDuplicateError
+)
+
+// JSONIntWidth controls how UnmarshalJSONOptions encodes integers.
+type JSONIntWidth int
+
+const (
+	// JSONIntMinimal uses a positive or negative fixint if the value fits,
+	// then the smallest Uint for positive values and Int for negative ones.
+	JSONIntMinimal JSONIntWidth = iota
+
+	// JSONIntSigned uses the smallest of Int8, Int16, Int32 and Int64.
+	// Values above math.MaxInt64 fail.
+	JSONIntSigned
+
+	// JSONIntAlways64 uses Int64, or Uint64 for values above math.MaxInt64.
+	JSONIntAlways64
+)
+
+// JSONFloatWidth controls how UnmarshalJSONOptions encodes numbers with a
+// fraction or exponent.
+type JSONFloatWidth int
+
+const (
+	// JSONFloatAlways64 uses Float64.
+	JSONFloatAlways64 JSONFloatWidth = iota
+
+	// JSONFloatSmallest uses Float32 if the value survives the conversion
+	// to float32 unchanged, and Float64 otherwise.
+	JSONFloatSmallest
+
+	// JSONFloatAlways32 uses Float32, even if that loses precision.
+	JSONFloatAlways32
 )
 
 // UnmarshalJSON unmarshals a lossy JSON representation of a msgpack object
 // into a Node.
 func UnmarshalJSON(b []byte, extra bool) (Node, error) {
-	var intf interface{}
+	return UnmarshalJSONOptions(b, JSONDecodeOptions{Extra: extra})
+}
+
+// UnmarshalJSONOptions is UnmarshalJSON with additional options.
+func UnmarshalJSONOptions(b []byte, opts JSONDecodeOptions) (Node, error) {
 	decoder := json.NewDecoder(bytes.NewReader(b))
 	decoder.UseNumber()
-	if err := decoder.Decode(&intf); err != nil {
+	node, err := jsonTokenToNode(decoder, &opts)
+	if err != nil {
 		return nil, err
 	}
-	if decoder.More() && !extra {
+	if decoder.More() && !opts.Extra {
 		return nil, fmt.Errorf("extra bytes after JSON object")
 	}
-	node, err := jsonIntfToNode(intf)
+	return node, nil
+}
+
+// jsonTokenToNode reads the next JSON value from the decoder. Objects are
+// read a token at a time, rather than into a map, so their entries keep
+// their order.
+func jsonTokenToNode(decoder *json.Decoder, opts *JSONDecodeOptions) (Node, error) {
+	tok, err := decoder.Token()
 	if err != nil {
 		return nil, err
 	}
-	return node, nil
+
+	switch tok {
+	case json.Delim('['):
+		n := &ArrayNode{}
+		for decoder.More() {
+			cn, err := jsonTokenToNode(decoder, opts)
+			if err != nil {
+				return nil, err
+			}
+			n.Children = append(n.Children, cn)
+		}
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+
+		sz := len(n.Children)
+		switch {
+		case sz <= 15:
+			n.commonNode.Prefix = wfixarray(uint8(sz))
+		case sz <= math.MaxUint16:
+			n.commonNode.Prefix = Array16
+		default:
+			n.commonNode.Prefix = Array32
+		}
+		n.commonNode.Size = headerSize(n.commonNode.Prefix)
+		return n, nil
+
+	case json.Delim('{'):
+		n := &MapNode{}
+		var seen map[string]bool
+		if opts.DuplicateKeys == JSONDuplicateError {
+			seen = make(map[string]bool)
+		}
+		for decoder.More() {
+			offset := decoder.InputOffset()
+			tok, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			k := tok.(string)
+			if seen != nil {
+				if seen[k] {
+					return nil, fmt.Errorf("duplicate key %q in JSON object at offset %d", k, offset)
+				}
+				seen[k] = true
+			}
+
+			// Keys are always left as strings, even if they look like times.
+			ck, err := jsonIntfToNode(k, &JSONDecodeOptions{})
+			if err != nil {
+				return nil, err
+			}
+			cv, err := jsonTokenToNode(decoder, opts)
+			if err != nil {
+				return nil, err
+			}
+			n.Values = append(n.Values, KeyValueNode{Key: ck, Value: cv})
+		}
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+
+		if opts.SortKeys {
+			sort.SliceStable(n.Values, func(i, j int) bool {
+				return n.Values[i].Key.(*StrNode).Value < n.Values[j].Key.(*StrNode).Value
+			})
+		}
+
+		sz := len(n.Values)
+		switch {
+		case sz <= 15:
+			n.commonNode.Prefix = wfixmap(uint8(sz))
+		case sz <= math.MaxUint16:
+			n.commonNode.Prefix = Map16
+		default:
+			n.commonNode.Prefix = Map32
+		}
+		n.commonNode.Size = headerSize(n.commonNode.Prefix)
+		return n, nil
+
+	default:
+		return jsonIntfToNode(tok, opts)
+	}
 }
 
-func jsonIntfToNode(intf interface{}) (Node, error) {
+func jsonIntfToNode(intf interface{}, opts *JSONDecodeOptions) (Node, error) {
 	//	bool, for JSON booleans
-	//	float64, for JSON numbers
+	//	json.Number, for JSON numbers
 	//	string, for JSON strings
-	//	[]interface{}, for JSON arrays
-	//	map[string]interface{}, for JSON objects
 	//	nil for JSON null
 
 	switch v := intf.(type) {
@@ -41,67 +212,22 @@ func jsonIntfToNode(intf interface{}) (Node, error) {
 		if v == true {
 			return &BoolNode{commonNode: commonNode{Prefix: True, Size: int(sizes[True].size)}, Value: v}, nil
 		} else {
-			return &BoolNode{commonNode: commonNode{Prefix: False, Size: int(sizes[True].size)}, Value: v}, nil
+			return &BoolNode{commonNode: commonNode{Prefix: False, Size: int(sizes[False].size)}, Value: v}, nil
 		}
 
+	case nil:
+		return &NilNode{commonNode: commonNode{Prefix: Nil, Size: int(sizes[Nil].size)}}, nil
+
 	case json.Number:
-		if strings.ContainsAny(v.String(), ".eE") {
-			n, err := v.Float64()
-			if err != nil {
-				return nil, err
-			}
-			bits := make([]byte, 8)
-			byteOrder.PutUint64(bits, math.Float64bits(n))
-			return &FloatNode{
-				commonNode: commonNode{Prefix: Float64, Size: int(sizes[Float64].size)},
-				Bits:       bits,
-				Approx:     n}, nil
+		return jsonNumberToNode(v, opts)
 
-		} else {
-			n, err := v.Int64()
-			if err != nil {
-				return nil, err
-			}
-			bits := make([]byte, 8)
-
-			var prefix byte
-			var node Node
-
-			switch {
-			case n >= 0 && n < 128:
-				prefix = wfixint(byte(n))
-				node = &IntNode{Approx: n, Bits: bits}
-			case n < 0 && n >= -32 && isnfixint(byte(n)):
-				prefix = wnfixint(int8(n))
-				node = &IntNode{Approx: n, Bits: bits}
-			case n >= 128 && n < math.MaxUint8:
-				prefix = Uint8
-				node = &UintNode{Approx: uint64(n), Bits: bits}
-			case n >= math.MaxUint8 && n < math.MaxUint16:
-				prefix = Uint16
-				node = &UintNode{Approx: uint64(n), Bits: bits}
-			case n >= math.MaxUint16 && n < math.MaxUint32:
-				prefix = Uint32
-				node = &UintNode{Approx: uint64(n), Bits: bits}
-			case n < 0 && n >= math.MinInt8:
-				prefix = Int8
-				node = &IntNode{Approx: n, Bits: bits}
-			case n < math.MinInt8 && n >= math.MinInt16:
-				prefix = Int16
-				node = &IntNode{Approx: n, Bits: bits}
-			case n < math.MinInt16 && n >= math.MinInt32:
-				prefix = Int16
-				node = &IntNode{Approx: n, Bits: bits}
-			default:
-				prefix = Int64
-				node = &IntNode{Approx: n, Bits: bits}
+	case string:
+		if opts.TimeLayout != "" {
+			if t, err := time.Parse(opts.TimeLayout, v); err == nil {
+				return newExtensionNode(nil, writeTimestamp(t), nil)
 			}
-			byteOrder.PutUint64(bits, uint64(n))
-			node.setCommon(prefix, int(sizes[prefix].size))
-			return node, nil
 		}
 
-	case string:
 		var prefix byte
 		sz := len(v)
 		switch {
@@ -115,71 +241,105 @@ func jsonIntfToNode(intf interface{}) (Node, error) {
 			prefix = Str32
 		}
 		return &StrNode{
-			commonNode: commonNode{Prefix: prefix, Size: int(sizes[Int64].size)},
+			commonNode: commonNode{Prefix: prefix, Size: headerSize(prefix)},
 			Value:      v}, nil
 
-	case []interface{}:
-		n := &ArrayNode{}
-		for _, i := range v {
-			cn, err := jsonIntfToNode(i)
-			if err != nil {
-				return nil, err
-			}
-			n.Children = append(n.Children, cn)
-		}
-		sz := len(n.Children)
-		n.commonNode.Size = sz
-		switch {
-		case sz <= 15:
-			n.commonNode.Prefix = wfixarray(uint8(sz))
-		case sz <= math.MaxUint16:
-			n.commonNode.Prefix = Array16
-		default:
-			n.commonNode.Prefix = Array32
-		}
-		return n, nil
+	default:
+		return nil, fmt.Errorf("unknown type %T", v)
+	}
+}
 
-	case map[string]interface{}:
-		vlen := len(v)
-		n := &MapNode{
-			Values: make([]KeyValueNode, vlen),
+func jsonNumberToNode(v json.Number, opts *JSONDecodeOptions) (Node, error) {
+	str := v.String()
+	if strings.ContainsAny(str, ".eE") {
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
 		}
-		n.commonNode.Size = vlen
+		return jsonFloatNode(f, opts.Floats), nil
+	}
 
-		keys := make([]string, vlen)
-		i := 0
-		for k := range v {
-			keys[i] = k
-			i++
-		}
-		sort.Strings(keys)
+	if n, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return jsonIntNode(n, opts.Ints), nil
+	}
 
-		i = 0
-		for _, k := range keys {
-			ck, err := jsonIntfToNode(k)
-			if err != nil {
-				return nil, err
-			}
-			cv, err := jsonIntfToNode(v[k])
-			if err != nil {
-				return nil, err
+	u, err := strconv.ParseUint(str, 10, 64)
+	if err != nil {
+		if opts.IntOverflowFloat {
+			if f, ferr := v.Float64(); ferr == nil {
+				return jsonFloatNode(f, opts.Floats), nil
 			}
-			n.Values[i] = KeyValueNode{Key: ck, Value: cv}
-			i++
 		}
+		return nil, err
+	}
+	if opts.Ints == JSONIntSigned {
+		return nil, fmt.Errorf("integer %s does not fit in a signed msgpack int", str)
+	}
+	return jsonUintNode(u, Uint64), nil
+}
 
-		sz := len(n.Values) * 2
+func jsonFloatNode(f float64, width JSONFloatWidth) Node {
+	if width == JSONFloatAlways32 || (width == JSONFloatSmallest && float64(float32(f)) == f) {
+		bits := make([]byte, 4)
+		byteOrder.PutUint32(bits, math.Float32bits(float32(f)))
+		return &FloatNode{
+			commonNode: commonNode{Prefix: Float32, Size: int(sizes[Float32].size)},
+			Bits:       bits,
+			Approx:     float64(float32(f))}
+	}
+
+	bits := make([]byte, 8)
+	byteOrder.PutUint64(bits, math.Float64bits(f))
+	return &FloatNode{
+		commonNode: commonNode{Prefix: Float64, Size: int(sizes[Float64].size)},
+		Bits:       bits,
+		Approx:     f}
+}
+
+func jsonIntNode(n int64, width JSONIntWidth) Node {
+	if width == JSONIntMinimal {
 		switch {
-		case sz <= 15:
-			n.commonNode.Prefix = wfixmap(uint8(sz))
-		case sz <= math.MaxUint16:
-			n.commonNode.Prefix = Map16
-		default:
-			n.commonNode.Prefix = Map32
+		case n >= 0 && n < 128:
+			return jsonSignedNode(n, wfixint(byte(n)))
+		case n < 0 && n >= -32:
+			return jsonSignedNode(n, wnfixint(int8(n)))
+		case n > 0 && n <= math.MaxUint8:
+			return jsonUintNode(uint64(n), Uint8)
+		case n > 0 && n <= math.MaxUint16:
+			return jsonUintNode(uint64(n), Uint16)
+		case n > 0 && n <= math.MaxUint32:
+			return jsonUintNode(uint64(n), Uint32)
+		case n > 0:
+			return jsonUintNode(uint64(n), Uint64)
 		}
-		return n, nil
+	}
 
+	switch {
+	case width == JSONIntAlways64:
+		return jsonSignedNode(n, Int64)
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		return jsonSignedNode(n, Int8)
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		return jsonSignedNode(n, Int16)
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		return jsonSignedNode(n, Int32)
 	default:
-		return nil, fmt.Errorf("unknown type %T", v)
+		return jsonSignedNode(n, Int64)
 	}
 }
+
+func jsonSignedNode(n int64, prefix byte) Node {
+	bits := make([]byte, 8)
+	byteOrder.PutUint64(bits, uint64(n))
+	node := &IntNode{Approx: n, Bits: bits}
+	node.setCommon(prefix, int(sizes[prefix].size))
+	return node
+}
+
+func jsonUintNode(u uint64, prefix byte) Node {
+	bits := make([]byte, 8)
+	byteOrder.PutUint64(bits, u)
+	node := &UintNode{Approx: u, Bits: bits}
+	node.setCommon(prefix, int(sizes[prefix].size))
+	return node
+}
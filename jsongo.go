@@ -5,6 +5,7 @@
 package msgplens
 
 import (
+	"bytes"
 	"fmt"
 	"math"
 	"strconv"
@@ -89,8 +90,25 @@ func (j *JSONEncoder) writeJSONString(s string) {
 func (j *JSONEncoder) writeJSONFloat(f float64) error {
 	bits := 64
 	if math.IsInf(f, 0) || math.IsNaN(f) {
-		return fmt.Errorf("unsupported value: %v", f)
+		switch j.opts.NonFinite {
+		case JSONNonFiniteNull:
+			j.open()
+			j.write(j.theme.Type, "null")
+		case JSONNonFiniteString:
+			s := "NaN"
+			if math.IsInf(f, 1) {
+				s = "Infinity"
+			} else if math.IsInf(f, -1) {
+				s = "-Infinity"
+			}
+			j.open()
+			j.write(j.theme.String, `"`+s+`"`)
+		default:
+			return fmt.Errorf("unsupported value %v", f)
+		}
+		return j.err()
 	}
+	j.open()
 
 	// Convert as if by ES6 number to string conversion.
 	// This matches most other JSON generators.
@@ -115,12 +133,17 @@ func (j *JSONEncoder) writeJSONFloat(f float64) error {
 			b = b[:n-1]
 		}
 	}
-	j.buf.Write(b)
-	return nil
+	j.write(j.theme.Float, string(b))
+	return j.err()
 }
 
+// String returns the output of a JSONEncoder from NewJSONEncoder. It is empty
+// for a JSONEncoder from NewJSONStreamEncoder.
 func (j *JSONEncoder) String() string {
-	return j.buf.String()
+	if buf, ok := j.buf.(*bytes.Buffer); ok {
+		return buf.String()
+	}
+	return ""
 }
 
 var safeSet = [utf8.RuneSelf]bool{
@@ -1,13 +1,26 @@
 package msgplens
 
-import "fmt"
+import (
+	"io"
+	"io/ioutil"
+)
 
 // Visitor provides functions that will be called as a msgpack object
 // is walked for each different kind of child object that is encountered.
+//
+// Any callback may return ErrStopWalk to end the walk early, and the Enter
+// callbacks may return ErrSkipChildren to skip the object they are entering.
+// Any other error ends the walk and is returned wrapped in a *WalkError.
 type Visitor struct {
 	Begin func(ctx *LensContext) error
 	End   func(ctx *LensContext, left []byte) error
 
+	// EnterRoot and LeaveRoot are called before and after each top level
+	// object. n is the index of the object in the input, which is only ever
+	// greater than zero when walking every object in a stream.
+	EnterRoot func(ctx *LensContext, n int) error
+	LeaveRoot func(ctx *LensContext, n int) error
+
 	Str     func(ctx *LensContext, bts []byte, str string) error
 	Int     func(ctx *LensContext, bts []byte, i int64) error
 	Uint    func(ctx *LensContext, bts []byte, u uint64) error
@@ -30,156 +43,419 @@ type Visitor struct {
 	LeaveMap     func(ctx *LensContext, prefix byte, cnt int, bts []byte) error
 
 	Extension func(ctx *LensContext, bts []byte) error
+
+	// StrStream and BinStream are called instead of Str and Bin by WalkReader
+	// when a payload is too large to buffer. rdr yields the size bytes of the
+	// payload (without the header); anything left unread when the callback
+	// returns is discarded. If they are nil, the payload is buffered in full
+	// and passed to Str or Bin as usual.
+	StrStream func(ctx *LensContext, prefix byte, size int, rdr io.Reader) error
+	BinStream func(ctx *LensContext, prefix byte, size int, rdr io.Reader) error
 }
 
 type Visitable interface {
 	Visitor() *Visitor
 }
 
+// Visitor allows a *Visitor to be used directly as a Visitable.
+func (v *Visitor) Visitor() *Visitor { return v }
+
 // WalkBytes walks the bytes in a msgpack object and visits each of the types
-// using the Visitor created by a Visitable.
+// using the Visitor created by a Visitable. It uses DefaultWalkOptions.
 func WalkBytes(v Visitable, bts []byte) error {
-	ctx := &LensContext{
-		bts: bts,
-		cur: 0,
-		cnt: len(bts),
-		vis: v.Visitor(),
-	}
-	return ctx.walkRoot()
+	return DefaultWalkOptions.WalkBytes(v, bts)
+}
+
+// WalkAllBytes walks every msgpack object in a sequence of concatenated
+// objects, visiting each in order. Visitor.End is called once after the last
+// object with no bytes remaining. It uses DefaultWalkOptions.
+func WalkAllBytes(v Visitable, bts []byte) error {
+	return DefaultWalkOptions.WalkAllBytes(v, bts)
+}
+
+// WalkReader walks a msgpack object read incrementally from rdr, visiting
+// each of the types using the Visitor created by a Visitable. It uses
+// DefaultWalkOptions.
+//
+// Str and Bin payloads larger than an internal threshold are passed to
+// Visitor.StrStream and Visitor.BinStream if they are set, so memory use does
+// not depend on the size of the input. Any bytes remaining after the object
+// are read in full and passed to Visitor.End.
+//
+// The bts argument passed to LeaveArray and LeaveMap is always nil when
+// walking a reader.
+func WalkReader(v Visitable, rdr io.Reader) error {
+	return DefaultWalkOptions.WalkReader(v, rdr)
+}
+
+// WalkAllReader is the io.Reader equivalent of WalkAllBytes. Objects are read
+// incrementally as they are for WalkReader. It uses DefaultWalkOptions.
+func WalkAllReader(v Visitable, rdr io.Reader) error {
+	return DefaultWalkOptions.WalkAllReader(v, rdr)
 }
 
 type LensContext struct {
-	bts  []byte
-	last int
-	cur  int
-	cnt  int
+	cursor
+	root    int
+	rootPos int
+	multi   bool
+	stack   []lensFrame
 
 	vis *Visitor
 }
 
+// lensFrame tracks the progress through a container that is being walked.
+type lensFrame struct {
+	prefix byte
+	cnt    int
+	start  int
+	isMap  bool
+
+	// idx is the index of the element or map entry currently being walked.
+	idx int
+
+	// key is the decoded key of the current map entry, valid if keySet.
+	inKey  bool
+	keySet bool
+	key    interface{}
+}
+
+// Container describes an array or map that encloses the object currently
+// being visited.
+type Container struct {
+	Prefix byte
+
+	// Count is the number of elements in an array or entries in a map.
+	Count int
+
+	// Pos is the offset of the container's prefix.
+	Pos int
+
+	// Index is the index of the element or entry currently being visited.
+	Index int
+}
+
+// Type returns ArrayType or MapType.
+func (c Container) Type() Type { return getType(c.Prefix) }
+
+// Parent returns the innermost container enclosing the object currently
+// being visited, or false if it is a top level object.
+func (c *LensContext) Parent() (Container, bool) {
+	depth := len(c.stack) - 1
+	if depth < 0 {
+		return Container{}, false
+	}
+	f := &c.stack[depth]
+	return Container{Prefix: f.prefix, Count: f.cnt, Pos: f.start, Index: f.idx}, true
+}
+
+// Pos returns the offset of the object currently being visited.
 func (c *LensContext) Pos() int { return c.last }
 
+// Root returns the index of the top level object currently being visited.
+func (c *LensContext) Root() int { return c.root }
+
+// RootPos returns the offset of the top level object currently being visited.
+func (c *LensContext) RootPos() int { return c.rootPos }
+
+// Depth returns the number of containers that enclose the object currently
+// being visited. It is zero for a top level object, including while a top
+// level array or map is entered and left.
+func (c *LensContext) Depth() int { return len(c.stack) }
+
+// Path returns the location of the object currently being visited relative
+// to its top level object. Like Depth, it doesn't include the container
+// being entered or left in EnterArray, EnterMap, LeaveArray and LeaveMap.
+func (c *LensContext) Path() Path {
+	if len(c.stack) == 0 {
+		return nil
+	}
+	p := make(Path, len(c.stack))
+	for i := range c.stack {
+		f := &c.stack[i]
+		switch {
+		case !f.isMap:
+			p[i] = f.idx
+		case f.inKey || !f.keySet:
+			p[i] = MapKey(f.idx)
+		default:
+			p[i] = f.key
+		}
+	}
+	return p
+}
+
 func (c *LensContext) walkRoot() error {
 	if c.vis.Begin != nil {
 		if err := c.vis.Begin(c); err != nil {
-			return err
+			return c.callbackFailed(err, c.src.pos())
 		}
 	}
-	if err := c.walk(); err != nil {
-		return fmt.Errorf("walk failed at position %d/%d: %v", c.cur, c.cnt, err)
+	for {
+		c.rootPos = c.src.pos()
+		skip := false
+		if c.vis.EnterRoot != nil {
+			if err := c.vis.EnterRoot(c, c.root); err == ErrSkipChildren {
+				skip = true
+			} else if err != nil {
+				return c.callbackFailed(err, c.rootPos)
+			}
+		}
+
+		var err error
+		if skip {
+			err = c.skip(1)
+		} else {
+			err = c.walk()
+		}
+		if err == ErrStopWalk {
+			return nil
+		} else if err != nil {
+			return c.walkFailed(err)
+		}
+
+		if c.vis.LeaveRoot != nil {
+			if err := c.vis.LeaveRoot(c, c.root); err != nil && err != ErrSkipChildren {
+				return c.callbackFailed(err, c.rootPos)
+			}
+		}
+		if !c.multi {
+			break
+		}
+		if next, err := c.src.peek(1); err != nil {
+			return err
+		} else if len(next) == 0 {
+			break
+		}
+		c.root++
 	}
 	if c.vis.End != nil {
-		if err := c.vis.End(c, c.bts[c.cur:]); err != nil {
+		left, err := c.src.rest()
+		if err != nil {
 			return err
 		}
+		if err := c.vis.End(c, left); err != nil {
+			return c.callbackFailed(err, c.src.pos())
+		}
 	}
 	return nil
 }
 
-func (c *LensContext) walkArray(contents []byte, objs uintptr) error {
+// walkNested walks a msgpack document nested in the extension currently
+// being visited. The document counts towards MaxDepth as a container nested
+// in the extension's containers, and its objects count towards MaxElements,
+// so nesting extensions can't be used to exceed either limit.
+func (c *LensContext) walkNested(v Visitable, bts []byte) error {
+	sub := &LensContext{
+		cursor: cursor{
+			opts:  c.opts,
+			src:   &bytesSource{bts: bts},
+			elems: c.elems,
+			depth: c.depth + len(c.stack) + 1,
+		},
+		vis: v.Visitor(),
+	}
+	err := sub.walkRoot()
+	c.elems = sub.elems
+	return err
+}
+
+// callbackFailed wraps an error returned by a callback that is called
+// outside of any object, such as Begin or EnterRoot, at the offset pos.
+// ErrStopWalk ends the walk without an error.
+func (c *LensContext) callbackFailed(err error, pos int) error {
+	if err == ErrStopWalk {
+		return nil
+	}
+	c.last, c.prefix = pos, -1
+	return c.walkFailed(err)
+}
+
+func (c *LensContext) walkFailed(err error) error {
+	return c.walkError(err, c.root, c.Path(), c.multi)
+}
+
+func (c *LensContext) walkArray(prefix byte, objs uintptr) error {
 	start := c.last
-	if c.vis.EnterArray != nil {
-		if err := c.vis.EnterArray(c, contents[0], int(objs)); err != nil {
-			return err
-		}
+	cnt := int(objs)
+
+	skip, err := c.enter(c.vis.EnterArray, prefix, cnt)
+	if err != nil {
+		return err
 	}
-	for i := 0; i < int(objs); i++ {
-		if c.vis.EnterArrayElem != nil {
-			if err := c.vis.EnterArrayElem(c, i, int(objs)); err != nil {
-				return nil
-			}
-		}
-		if err := c.walk(); err != nil {
+
+	c.stack = append(c.stack, lensFrame{prefix: prefix, cnt: cnt, start: start})
+	depth := len(c.stack) - 1
+
+	if skip {
+		if err := c.skip(objs); err != nil {
 			return err
 		}
-		if c.vis.LeaveArrayElem != nil {
-			if err := c.vis.LeaveArrayElem(c, i, int(objs)); err != nil {
-				return nil
+	} else {
+		for i := 0; i < cnt; i++ {
+			c.stack[depth].idx = i
+			if err := c.walkElem(c.vis.EnterArrayElem, c.vis.LeaveArrayElem, i, cnt); err != nil {
+				return err
 			}
 		}
 	}
+
+	c.stack = c.stack[:depth]
+
 	if c.vis.LeaveArray != nil {
-		if err := c.vis.LeaveArray(c, contents[0], int(objs), c.bts[start:c.cur]); err != nil {
+		if err := c.vis.LeaveArray(c, prefix, cnt, c.src.since(start)); err != nil && err != ErrSkipChildren {
 			return err
 		}
 	}
 	return nil
 }
 
-func (c *LensContext) walkMap(contents []byte, objs uintptr) error {
+func (c *LensContext) walkMap(prefix byte, objs uintptr) error {
 	start := c.last
 	lim := int(objs) / 2
 
-	if c.vis.EnterMap != nil {
-		if err := c.vis.EnterMap(c, contents[0], lim); err != nil {
-			return err
-		}
+	skip, err := c.enter(c.vis.EnterMap, prefix, lim)
+	if err != nil {
+		return err
 	}
-	for i := 0; i < lim; i++ {
-		if c.vis.EnterMapKey != nil {
-			if err := c.vis.EnterMapKey(c, i, lim); err != nil {
-				return nil
-			}
-		}
-		if err := c.walk(); err != nil {
+
+	c.stack = append(c.stack, lensFrame{prefix: prefix, cnt: lim, start: start, isMap: true})
+	depth := len(c.stack) - 1
+
+	if skip {
+		if err := c.skip(objs); err != nil {
 			return err
 		}
-		if c.vis.LeaveMapKey != nil {
-			if err := c.vis.LeaveMapKey(c, i, lim); err != nil {
-				return nil
+	} else {
+		for i := 0; i < lim; i++ {
+			f := &c.stack[depth]
+			f.idx, f.inKey, f.keySet, f.key = i, true, false, nil
+			if err := c.walkElem(c.vis.EnterMapKey, c.vis.LeaveMapKey, i, lim); err != nil {
+				return err
 			}
-		}
-		if c.vis.EnterMapElem != nil {
-			if err := c.vis.EnterMapElem(c, i, lim); err != nil {
-				return nil
+
+			c.stack[depth].inKey = false
+			if err := c.walkElem(c.vis.EnterMapElem, c.vis.LeaveMapElem, i, lim); err != nil {
+				return err
 			}
 		}
-		if err := c.walk(); err != nil {
+	}
+
+	c.stack = c.stack[:depth]
+
+	if c.vis.LeaveMap != nil {
+		if err := c.vis.LeaveMap(c, prefix, lim, c.src.since(start)); err != nil && err != ErrSkipChildren {
 			return err
 		}
-		if c.vis.LeaveMapElem != nil {
-			if err := c.vis.LeaveMapElem(c, i, lim); err != nil {
-				return nil
-			}
+	}
+	return nil
+}
+
+// enter calls EnterArray or EnterMap if it is set, and reports whether the
+// callback asked for the container's contents to be skipped.
+func (c *LensContext) enter(fn func(ctx *LensContext, prefix byte, cnt int) error, prefix byte, cnt int) (skip bool, err error) {
+	if fn == nil {
+		return false, nil
+	}
+	err = fn(c, prefix, cnt)
+	if err == ErrSkipChildren {
+		return true, nil
+	}
+	return false, err
+}
+
+// walkElem walks a single array element, map key or map value, calling the
+// enter and leave callbacks around it. If enter returns ErrSkipChildren, the
+// object is skipped rather than walked, but leave is still called.
+func (c *LensContext) walkElem(enter, leave func(ctx *LensContext, n, cnt int) error, n, cnt int) error {
+	skip := false
+	if enter != nil {
+		if err := enter(c, n, cnt); err == ErrSkipChildren {
+			skip = true
+		} else if err != nil {
+			return err
 		}
 	}
-	if c.vis.LeaveMap != nil {
-		if err := c.vis.LeaveMap(c, contents[0], lim, c.bts[start:c.cur]); err != nil {
+	if skip {
+		if err := c.skip(1); err != nil {
+			return err
+		}
+	} else if err := c.walk(); err != nil {
+		return err
+	}
+	if leave != nil {
+		if err := leave(c, n, cnt); err != nil && err != ErrSkipChildren {
 			return err
 		}
 	}
 	return nil
 }
 
+// setKey records the decoded value of a map key if the object at the top of
+// the walk is the key of the innermost map.
+func (c *LensContext) setKey(typ Type, prefix byte, contents []byte) {
+	depth := len(c.stack) - 1
+	if depth < 0 || !c.stack[depth].inKey || c.stack[depth].keySet {
+		return
+	}
+
+	if typ == ExtensionType {
+		return
+	}
+	key, err := scalarValue(typ, prefix, contents)
+	if err == nil {
+		c.stack[depth].key, c.stack[depth].keySet = key, true
+	}
+}
+
 func (c *LensContext) walk() error {
-	if c.cur >= c.cnt {
-		return fmt.Errorf("tried to walk past end")
+	prefix, sz, objs, err := c.header()
+	if err != nil {
+		return err
+	}
+	typ := getType(prefix)
+
+	if typ == ArrayType || typ == MapType {
+		if err := c.checkDepth(len(c.stack)); err != nil {
+			return err
+		}
 	}
 
-	typ := getType(c.bts[c.cur])
-	prefix := c.bts[c.cur]
-	sz, objs, err := getSize(c.bts[c.cur:])
+	if (typ == StrType || typ == BinType) && c.src.streamable(int(sz)) {
+		stream := c.vis.StrStream
+		if typ == BinType {
+			stream = c.vis.BinStream
+		}
+		if stream != nil {
+			return c.walkStream(stream, prefix, int(sz))
+		}
+	}
+
+	contents, err := c.src.next(int(sz))
 	if err != nil {
 		return err
 	}
+	c.setKey(typ, prefix, contents)
 
-	contents := c.bts[c.cur : c.cur+int(sz)]
-	c.last = c.cur
-	c.cur += int(sz)
+	if err := c.visit(typ, prefix, contents, objs); err != nil && err != ErrSkipChildren {
+		return err
+	}
+	return nil
+}
 
+func (c *LensContext) visit(typ Type, prefix byte, contents []byte, objs uintptr) error {
 	switch typ {
 	case ArrayType:
-		if err := c.walkArray(contents, objs); err != nil {
+		if err := c.walkArray(prefix, objs); err != nil {
 			return err
 		}
 	case MapType:
-		if err := c.walkMap(contents, objs); err != nil {
+		if err := c.walkMap(prefix, objs); err != nil {
 			return err
 		}
 	case StrType:
 		if c.vis.Str != nil {
-			idx := 1
-			idx += -int(sizes[prefix].extra)
+			idx := headerSize(prefix)
 			if err := c.vis.Str(c, contents, string(contents[idx:])); err != nil {
 				return err
 			}
@@ -195,7 +471,7 @@ func (c *LensContext) walk() error {
 			}
 		}
 	case UintType:
-		if c.vis.Int != nil {
+		if c.vis.Uint != nil {
 			u, err := readUint64(contents)
 			if err != nil {
 				return err
@@ -206,8 +482,7 @@ func (c *LensContext) walk() error {
 		}
 	case BinType:
 		if c.vis.Bin != nil {
-			idx := 1
-			idx += -int(sizes[prefix].extra)
+			idx := headerSize(prefix)
 			if err := c.vis.Bin(c, contents, contents[idx:]); err != nil {
 				return err
 			}
@@ -254,3 +529,24 @@ func (c *LensContext) walk() error {
 
 	return nil
 }
+
+func (c *LensContext) walkStream(
+	stream func(ctx *LensContext, prefix byte, size int, rdr io.Reader) error,
+	prefix byte, sz int,
+) error {
+	hsz := headerSize(prefix)
+	if _, err := c.src.next(hsz); err != nil {
+		return err
+	}
+	start := c.src.pos()
+	rdr := c.src.stream(sz - hsz)
+	if err := stream(c, prefix, sz-hsz, rdr); err != nil && err != ErrSkipChildren {
+		return err
+	}
+	if _, err := io.Copy(ioutil.Discard, rdr); err == io.ErrUnexpectedEOF {
+		return &shortReadError{expected: sz - hsz, available: c.src.pos() - start}
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,392 @@
+package msgplens
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// {"a": [1, -1, "foo", true, nil], "b": 1.5}
+var testObject = []byte{
+	0x82,
+	0xa1, 'a', 0x95, 0x01, 0xff, 0xa3, 'f', 'o', 'o', 0xc3, 0xc0,
+	0xa1, 'b', 0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0,
+}
+
+func TestWalkReaderMatchesWalkBytes(t *testing.T) {
+	var bout, rout bytes.Buffer
+	if err := WalkBytes(NewPrinter(&bout), testObject); err != nil {
+		t.Fatal(err)
+	}
+	if err := WalkReader(NewPrinter(&rout), bytes.NewReader(testObject)); err != nil {
+		t.Fatal(err)
+	}
+	if bout.String() != rout.String() {
+		t.Fatalf("output differs:\n%s\n%s", bout.String(), rout.String())
+	}
+}
+
+func TestWalkReaderStream(t *testing.T) {
+	sz := readerStreamThreshold * 3
+	in := []byte{Str32, 0, 0, 0, 0}
+	big.PutUint32(in[1:], uint32(sz))
+	in = append(in, strings.Repeat("é", sz/2)...)
+
+	var streamed int
+	var called bool
+	vis := &Visitor{
+		Str: func(ctx *LensContext, bts []byte, str string) error {
+			t.Fatal("Str called for streamable payload")
+			return nil
+		},
+		StrStream: func(ctx *LensContext, prefix byte, size int, rdr io.Reader) error {
+			called = true
+			if size != sz {
+				t.Fatalf("size %d != %d", size, sz)
+			}
+			n, err := io.Copy(ioutil.Discard, rdr)
+			streamed = int(n)
+			return err
+		},
+	}
+	if err := WalkReader(vis, bytes.NewReader(in)); err != nil {
+		t.Fatal(err)
+	}
+	if !called || streamed != sz {
+		t.Fatalf("streamed %d bytes, expected %d", streamed, sz)
+	}
+
+	// The printer must produce the same output whether or not it streams:
+	var bout, rout bytes.Buffer
+	if err := WalkBytes(NewPrinter(&bout), in); err != nil {
+		t.Fatal(err)
+	}
+	if err := WalkReader(NewPrinter(&rout), bytes.NewReader(in)); err != nil {
+		t.Fatal(err)
+	}
+	if bout.String() != rout.String() {
+		t.Fatal("streamed printer output differs")
+	}
+}
+
+func TestWalkShortRead(t *testing.T) {
+	in := []byte{Str32, 0, 0, 1, 0, 'a'}
+	if err := WalkBytes(&Visitor{}, in); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := WalkReader(&Visitor{}, bytes.NewReader(in)); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestWalkNegativeFixint(t *testing.T) {
+	in := []byte{0x94, 0xff, 0xe0, 0x7f, Int8, 0x80}
+
+	var ints []int64
+	vis := &Visitor{
+		Int: func(ctx *LensContext, bts []byte, data int64) error {
+			ints = append(ints, data)
+			return nil
+		},
+	}
+	if err := WalkBytes(vis, in); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []int64{-1, -32, 127, -128}; !reflect.DeepEqual(ints, exp) {
+		t.Fatalf("%v != %v", ints, exp)
+	}
+}
+
+func TestWalkAll(t *testing.T) {
+	in := append(append([]byte{0x01}, testObject...), 0x91, 0xc0)
+
+	var pos []int
+	vis := &Visitor{
+		EnterRoot: func(ctx *LensContext, n int) error {
+			if n != len(pos) {
+				t.Fatalf("root %d != %d", n, len(pos))
+			}
+			pos = append(pos, ctx.RootPos())
+			return nil
+		},
+	}
+	expected := []int{0, 1, 1 + len(testObject)}
+
+	if err := WalkAllBytes(vis, in); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pos, expected) {
+		t.Fatalf("%v != %v", pos, expected)
+	}
+
+	pos = nil
+	if err := WalkAllReader(vis, bytes.NewReader(in)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pos, expected) {
+		t.Fatalf("%v != %v", pos, expected)
+	}
+
+	repr := NewRepresenter()
+	if err := WalkAllBytes(repr, in); err != nil {
+		t.Fatal(err)
+	}
+	if len(repr.Nodes()) != 3 {
+		t.Fatalf("expected 3 nodes, found %d", len(repr.Nodes()))
+	}
+	if !reflect.DeepEqual(repr.Offsets(), expected) {
+		t.Fatalf("%v != %v", repr.Offsets(), expected)
+	}
+	doc, err := ReprMarshalOffsets(repr.Nodes(), repr.Offsets())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := fmt.Sprintf(`{"Root":2,"Pos":%d,"Prefix":145`, 1+len(testObject)); !strings.Contains(string(doc), s) {
+		t.Fatalf("%s not found in:\n%s", s, doc)
+	}
+
+	enc := NewJSONEncoder()
+	if err := WalkAllBytes(enc, in); err != nil {
+		t.Fatal(err)
+	}
+	exp := fmt.Sprintf(""+
+		`{"root":0,"pos":0,"value":1}`+"\n"+
+		`{"root":1,"pos":1,"value":{"a":[1,-1,"foo",true,null],"b":1.5}}`+"\n"+
+		`{"root":2,"pos":%d,"value":[null]}`+"\n", 1+len(testObject))
+	if enc.String() != exp {
+		t.Fatalf("unexpected JSON %q", enc.String())
+	}
+
+	enc = NewJSONEncoderWithOptions(JSONOptions{Indent: 2})
+	if err := WalkAllBytes(enc, in[len(in)-2:]); err != nil {
+		t.Fatal(err)
+	}
+	if exp := "{\n  \"root\": 0,\n  \"pos\": 0,\n  \"value\": [\n    null\n  ]\n}\n"; enc.String() != exp {
+		t.Fatalf("%q != %q", enc.String(), exp)
+	}
+}
+
+func TestWalkError(t *testing.T) {
+	// {"users": [1, 2, 3, {"name": <Str8 of 10 bytes, truncated to 3>}]}
+	in := []byte{
+		0x81, 0xa5, 'u', 's', 'e', 'r', 's',
+		0x94, 0x01, 0x02, 0x03,
+		0x81, 0xa4, 'n', 'a', 'm', 'e',
+		Str8, 10, 'b', 'o', 'b',
+	}
+
+	for _, walk := range []func() error{
+		func() error { return WalkBytes(&Visitor{}, in) },
+		func() error { return WalkReader(&Visitor{}, bytes.NewReader(in)) },
+	} {
+		err := walk()
+		werr, ok := err.(*WalkError)
+		if !ok {
+			t.Fatalf("expected *WalkError, found %T: %v", err, err)
+		}
+		if !errors.Is(err, ErrShortRead) {
+			t.Fatalf("expected ErrShortRead, found %v", werr.Err)
+		}
+		if werr.Offset != 17 || werr.Prefix != Str8 || werr.PrefixName != "Str8" {
+			t.Fatalf("unexpected error position: %v", werr)
+		}
+		if werr.Path.String() != "/users/3/name" {
+			t.Fatalf("unexpected path %q", werr.Path)
+		}
+		if werr.Expected != 12 || werr.Available != 5 {
+			t.Fatalf("expected 12/5 bytes, found %d/%d", werr.Expected, werr.Available)
+		}
+	}
+
+	err := WalkBytes(&Visitor{}, []byte{0x92, 0x01, 0xc1})
+	if werr, ok := err.(*WalkError); !ok || werr.Err != ErrInvalidPrefix || werr.Offset != 2 || werr.Path.String() != "/1" {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestWalkErrorFromRootCallbacks(t *testing.T) {
+	fail := errors.New("fail")
+	in := []byte{0x01, 0x92, 0x02, 0x03}
+	for _, tc := range []struct {
+		vis    *Visitor
+		root   int
+		offset int
+	}{
+		{&Visitor{Begin: func(ctx *LensContext) error { return fail }}, 0, 0},
+		{&Visitor{EnterRoot: func(ctx *LensContext, n int) error {
+			if n == 1 {
+				return fail
+			}
+			return nil
+		}}, 1, 1},
+		{&Visitor{LeaveRoot: func(ctx *LensContext, n int) error {
+			if n == 1 {
+				return fail
+			}
+			return nil
+		}}, 1, 1},
+		{&Visitor{End: func(ctx *LensContext, left []byte) error { return fail }}, 1, 4},
+	} {
+		err := WalkAllBytes(tc.vis, in)
+		werr, ok := err.(*WalkError)
+		if !ok || werr.Err != fail {
+			t.Fatalf("expected *WalkError, found %T: %v", err, err)
+		}
+		if werr.Root != tc.root || werr.Offset != tc.offset || werr.PrefixName != "" {
+			t.Fatalf("unexpected error position: %v", werr)
+		}
+	}
+}
+
+func TestWalkSkipAndStop(t *testing.T) {
+	for _, tc := range []struct {
+		vis      func(seen *[]string) *Visitor
+		expected []string
+	}{
+		{ // Skip the contents of "a" but still see "b":
+			vis: func(seen *[]string) *Visitor {
+				return &Visitor{
+					EnterArray: func(ctx *LensContext, prefix byte, cnt int) error {
+						*seen = append(*seen, "enter")
+						return ErrSkipChildren
+					},
+					LeaveArray: func(ctx *LensContext, prefix byte, cnt int, bts []byte) error {
+						*seen = append(*seen, "leave")
+						return nil
+					},
+					Str: func(ctx *LensContext, bts []byte, str string) error {
+						*seen = append(*seen, str)
+						return nil
+					},
+					Float64: func(ctx *LensContext, bts []byte, f float64) error {
+						*seen = append(*seen, "float")
+						return nil
+					},
+				}
+			},
+			expected: []string{"a", "enter", "leave", "b", "float"},
+		},
+
+		{ // Skip the value of the first map entry only:
+			vis: func(seen *[]string) *Visitor {
+				return &Visitor{
+					EnterMapElem: func(ctx *LensContext, n, cnt int) error {
+						if n == 0 {
+							return ErrSkipChildren
+						}
+						return nil
+					},
+					Str: func(ctx *LensContext, bts []byte, str string) error {
+						*seen = append(*seen, str)
+						return nil
+					},
+					Float64: func(ctx *LensContext, bts []byte, f float64) error {
+						*seen = append(*seen, "float")
+						return nil
+					},
+				}
+			},
+			expected: []string{"a", "b", "float"},
+		},
+
+		{ // Stop at the first string inside the array:
+			vis: func(seen *[]string) *Visitor {
+				return &Visitor{
+					Str: func(ctx *LensContext, bts []byte, str string) error {
+						*seen = append(*seen, str)
+						if str == "foo" {
+							return ErrStopWalk
+						}
+						return nil
+					},
+					End: func(ctx *LensContext, left []byte) error {
+						*seen = append(*seen, "end")
+						return nil
+					},
+				}
+			},
+			expected: []string{"a", "foo"},
+		},
+	} {
+		var seen []string
+		if err := WalkBytes(tc.vis(&seen), testObject); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(seen, tc.expected) {
+			t.Fatalf("%v != %v", seen, tc.expected)
+		}
+
+		seen = nil
+		if err := WalkReader(tc.vis(&seen), bytes.NewReader(testObject)); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(seen, tc.expected) {
+			t.Fatalf("%v != %v", seen, tc.expected)
+		}
+	}
+}
+
+func TestLensContextPath(t *testing.T) {
+	var found []string
+	var ints int
+	vis := &Visitor{
+		Int: func(ctx *LensContext, bts []byte, i int64) error {
+			parent, ok := ctx.Parent()
+			if !ok || parent.Type() != ArrayType || parent.Pos != 3 || parent.Count != 5 || parent.Index != ints {
+				t.Fatalf("unexpected parent %+v", parent)
+			}
+			found = append(found, fmt.Sprintf("%d %s", ctx.Depth(), ctx.Path()))
+			ints++
+			return nil
+		},
+		Float64: func(ctx *LensContext, bts []byte, f float64) error {
+			found = append(found, fmt.Sprintf("%d %s", ctx.Depth(), ctx.Path()))
+			return nil
+		},
+		EnterArray: func(ctx *LensContext, prefix byte, cnt int) error {
+			found = append(found, fmt.Sprintf("%d %s", ctx.Depth(), ctx.Path()))
+			return nil
+		},
+	}
+	if err := WalkBytes(vis, testObject); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"1 /a", "2 /a/0", "2 /a/1", "1 /b"}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("%v != %v", found, expected)
+	}
+}
+
+func TestWalkOptionsLimits(t *testing.T) {
+	for idx, tc := range []struct {
+		opts WalkOptions
+		in   []byte
+	}{
+		{WalkOptions{MaxDepth: 2}, []byte{0x91, 0x91, 0x91, 0xc0}},
+		{WalkOptions{MaxContainerLen: 2}, []byte{0x93, 0x01, 0x02, 0x03}},
+		{WalkOptions{MaxContainerLen: 1}, []byte{0x82, 0x01, 0x02, 0x03, 0x04}},
+		{WalkOptions{MaxElements: 3}, []byte{0x93, 0x01, 0x02, 0x03}},
+	} {
+		err := tc.opts.WalkBytes(&Visitor{}, tc.in)
+		if !errors.Is(err, ErrLimitExceeded) {
+			t.Fatalf("%d: expected ErrLimitExceeded, found %v", idx, err)
+		}
+	}
+
+	// A huge Array32 header must fail before any children are walked:
+	in := []byte{Array32, 0xff, 0xff, 0xff, 0xff, 0xc0}
+	err := WalkOptions{Strict: true}.WalkBytes(&Visitor{
+		Nil: func(ctx *LensContext, prefix byte) error {
+			t.Fatal("child visited")
+			return nil
+		},
+	}, in)
+	if !errors.Is(err, ErrShortRead) {
+		t.Fatalf("expected ErrShortRead, found %v", err)
+	}
+}
@@ -0,0 +1,322 @@
+package msgplens
+
+// MultiVisitor returns a Visitable that passes every callback to each of vs
+// in turn, so several visitors can share a single walk.
+//
+// If any visitor returns an error other than ErrSkipChildren or ErrStopWalk,
+// the walk ends immediately with that error and the remaining visitors are
+// not called.
+//
+// A visitor that returns ErrStopWalk receives no further callbacks, including
+// End. The walk itself only stops once every visitor has stopped.
+//
+// A visitor that returns ErrSkipChildren from an Enter callback receives no
+// further callbacks until the matching Leave callback, which it does
+// receive. The walker only skips the object, without decoding it, if none of
+// the visitors still want it.
+//
+// Visitors that stopped or skipped are called again from the start of the
+// next walk, so the Visitable can be walked more than once.
+//
+// StrStream and BinStream are not used, so large payloads are buffered in
+// full and passed to Str and Bin.
+func MultiVisitor(vs ...Visitable) Visitable {
+	m := &multiVisitor{}
+	for _, v := range vs {
+		m.vis = append(m.vis, multiEntry{vis: v.Visitor()})
+	}
+	m.reset()
+	m.build()
+	return m
+}
+
+type multiVisitor struct {
+	vis    []multiEntry
+	out    *Visitor
+	active int
+
+	// level is the number of Enter callbacks that have not yet been matched
+	// by a Leave callback.
+	level int
+}
+
+type multiEntry struct {
+	vis     *Visitor
+	stopped bool
+
+	// skipLevel is the level at which the visitor returned ErrSkipChildren,
+	// or -1. While the level is greater than skipLevel, the visitor is
+	// suspended.
+	skipLevel int
+}
+
+func (m *multiVisitor) Visitor() *Visitor { return m.out }
+
+// reset readies every visitor for a new walk, whether or not it stopped or
+// skipped during the last one.
+func (m *multiVisitor) reset() {
+	for i := range m.vis {
+		m.vis[i].stopped, m.vis[i].skipLevel = false, -1
+	}
+	m.active, m.level = len(m.vis), 0
+}
+
+func (m *multiVisitor) listening(e *multiEntry) bool {
+	return !e.stopped && (e.skipLevel < 0 || m.level <= e.skipLevel)
+}
+
+// each calls fn for every visitor that is still listening.
+func (m *multiVisitor) each(fn func(v *Visitor) error) error {
+	for i := range m.vis {
+		e := &m.vis[i]
+		if !m.listening(e) {
+			continue
+		}
+		if err := fn(e.vis); err == ErrStopWalk {
+			e.stopped = true
+			m.active--
+			if m.active == 0 {
+				return ErrStopWalk
+			}
+		} else if err != nil && err != ErrSkipChildren {
+			return err
+		}
+	}
+	return nil
+}
+
+// enter calls an Enter callback for every visitor that is still listening.
+// It returns ErrSkipChildren if none of them want what is being entered.
+func (m *multiVisitor) enter(fn func(v *Visitor) error) error {
+	wanted := false
+	for i := range m.vis {
+		e := &m.vis[i]
+		if !m.listening(e) {
+			continue
+		}
+		if err := fn(e.vis); err == ErrSkipChildren {
+			e.skipLevel = m.level
+		} else if err == ErrStopWalk {
+			e.stopped = true
+			m.active--
+			if m.active == 0 {
+				return ErrStopWalk
+			}
+		} else if err != nil {
+			return err
+		} else {
+			wanted = true
+		}
+	}
+	m.level++
+	if !wanted {
+		return ErrSkipChildren
+	}
+	return nil
+}
+
+// leave calls a Leave callback for every visitor that is listening once the
+// level is restored, which includes those that skipped the matching Enter.
+func (m *multiVisitor) leave(fn func(v *Visitor) error) error {
+	m.level--
+	err := m.each(fn)
+	for i := range m.vis {
+		if m.vis[i].skipLevel == m.level {
+			m.vis[i].skipLevel = -1
+		}
+	}
+	return err
+}
+
+func (m *multiVisitor) build() {
+	m.out = &Visitor{
+		Begin: func(ctx *LensContext) error {
+			m.reset()
+			return m.each(func(v *Visitor) error {
+				if v.Begin == nil {
+					return nil
+				}
+				return v.Begin(ctx)
+			})
+		},
+		End: func(ctx *LensContext, left []byte) error {
+			return m.each(func(v *Visitor) error {
+				if v.End == nil {
+					return nil
+				}
+				return v.End(ctx, left)
+			})
+		},
+		EnterRoot: func(ctx *LensContext, n int) error {
+			return m.enter(func(v *Visitor) error {
+				if v.EnterRoot == nil {
+					return nil
+				}
+				return v.EnterRoot(ctx, n)
+			})
+		},
+		LeaveRoot: func(ctx *LensContext, n int) error {
+			return m.leave(func(v *Visitor) error {
+				if v.LeaveRoot == nil {
+					return nil
+				}
+				return v.LeaveRoot(ctx, n)
+			})
+		},
+
+		Str: func(ctx *LensContext, bts []byte, str string) error {
+			return m.each(func(v *Visitor) error {
+				if v.Str == nil {
+					return nil
+				}
+				return v.Str(ctx, bts, str)
+			})
+		},
+		Int: func(ctx *LensContext, bts []byte, i int64) error {
+			return m.each(func(v *Visitor) error {
+				if v.Int == nil {
+					return nil
+				}
+				return v.Int(ctx, bts, i)
+			})
+		},
+		Uint: func(ctx *LensContext, bts []byte, u uint64) error {
+			return m.each(func(v *Visitor) error {
+				if v.Uint == nil {
+					return nil
+				}
+				return v.Uint(ctx, bts, u)
+			})
+		},
+		Bin: func(ctx *LensContext, bts []byte, bin []byte) error {
+			return m.each(func(v *Visitor) error {
+				if v.Bin == nil {
+					return nil
+				}
+				return v.Bin(ctx, bts, bin)
+			})
+		},
+		Float32: func(ctx *LensContext, bts []byte, f float32) error {
+			return m.each(func(v *Visitor) error {
+				if v.Float32 == nil {
+					return nil
+				}
+				return v.Float32(ctx, bts, f)
+			})
+		},
+		Float64: func(ctx *LensContext, bts []byte, f float64) error {
+			return m.each(func(v *Visitor) error {
+				if v.Float64 == nil {
+					return nil
+				}
+				return v.Float64(ctx, bts, f)
+			})
+		},
+		Bool: func(ctx *LensContext, bts []byte, b bool) error {
+			return m.each(func(v *Visitor) error {
+				if v.Bool == nil {
+					return nil
+				}
+				return v.Bool(ctx, bts, b)
+			})
+		},
+		Nil: func(ctx *LensContext, prefix byte) error {
+			return m.each(func(v *Visitor) error {
+				if v.Nil == nil {
+					return nil
+				}
+				return v.Nil(ctx, prefix)
+			})
+		},
+		Extension: func(ctx *LensContext, bts []byte) error {
+			return m.each(func(v *Visitor) error {
+				if v.Extension == nil {
+					return nil
+				}
+				return v.Extension(ctx, bts)
+			})
+		},
+
+		EnterArray: func(ctx *LensContext, prefix byte, cnt int) error {
+			return m.enter(func(v *Visitor) error {
+				if v.EnterArray == nil {
+					return nil
+				}
+				return v.EnterArray(ctx, prefix, cnt)
+			})
+		},
+		EnterArrayElem: func(ctx *LensContext, n, cnt int) error {
+			return m.enter(func(v *Visitor) error {
+				if v.EnterArrayElem == nil {
+					return nil
+				}
+				return v.EnterArrayElem(ctx, n, cnt)
+			})
+		},
+		LeaveArrayElem: func(ctx *LensContext, n, cnt int) error {
+			return m.leave(func(v *Visitor) error {
+				if v.LeaveArrayElem == nil {
+					return nil
+				}
+				return v.LeaveArrayElem(ctx, n, cnt)
+			})
+		},
+		LeaveArray: func(ctx *LensContext, prefix byte, cnt int, bts []byte) error {
+			return m.leave(func(v *Visitor) error {
+				if v.LeaveArray == nil {
+					return nil
+				}
+				return v.LeaveArray(ctx, prefix, cnt, bts)
+			})
+		},
+
+		EnterMap: func(ctx *LensContext, prefix byte, cnt int) error {
+			return m.enter(func(v *Visitor) error {
+				if v.EnterMap == nil {
+					return nil
+				}
+				return v.EnterMap(ctx, prefix, cnt)
+			})
+		},
+		EnterMapKey: func(ctx *LensContext, n, cnt int) error {
+			return m.enter(func(v *Visitor) error {
+				if v.EnterMapKey == nil {
+					return nil
+				}
+				return v.EnterMapKey(ctx, n, cnt)
+			})
+		},
+		LeaveMapKey: func(ctx *LensContext, n, cnt int) error {
+			return m.leave(func(v *Visitor) error {
+				if v.LeaveMapKey == nil {
+					return nil
+				}
+				return v.LeaveMapKey(ctx, n, cnt)
+			})
+		},
+		EnterMapElem: func(ctx *LensContext, n, cnt int) error {
+			return m.enter(func(v *Visitor) error {
+				if v.EnterMapElem == nil {
+					return nil
+				}
+				return v.EnterMapElem(ctx, n, cnt)
+			})
+		},
+		LeaveMapElem: func(ctx *LensContext, n, cnt int) error {
+			return m.leave(func(v *Visitor) error {
+				if v.LeaveMapElem == nil {
+					return nil
+				}
+				return v.LeaveMapElem(ctx, n, cnt)
+			})
+		},
+		LeaveMap: func(ctx *LensContext, prefix byte, cnt int, bts []byte) error {
+			return m.leave(func(v *Visitor) error {
+				if v.LeaveMap == nil {
+					return nil
+				}
+				return v.LeaveMap(ctx, prefix, cnt, bts)
+			})
+		},
+	}
+}
@@ -0,0 +1,98 @@
+package msgplens
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+type strHandler struct {
+	BaseHandler
+	seen []string
+}
+
+func (h *strHandler) Str(ctx *LensContext, bts []byte, str string) error {
+	h.seen = append(h.seen, str)
+	return nil
+}
+
+func (h *strHandler) EnterArray(ctx *LensContext, prefix byte, cnt int) error {
+	return ErrSkipChildren
+}
+
+func (h *strHandler) LeaveArray(ctx *LensContext, prefix byte, cnt int, bts []byte) error {
+	h.seen = append(h.seen, "leave")
+	return nil
+}
+
+func TestMultiVisitor(t *testing.T) {
+	var expected bytes.Buffer
+	if err := WalkBytes(NewPrinter(&expected), testObject); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	var stopped []string
+	h := &strHandler{}
+	stopper := &Visitor{
+		Str: func(ctx *LensContext, bts []byte, str string) error {
+			stopped = append(stopped, str)
+			if str == "foo" {
+				return ErrStopWalk
+			}
+			return nil
+		},
+	}
+
+	vis := MultiVisitor(NewPrinter(&out), NewHandlerVisitor(h), stopper)
+	if err := WalkBytes(vis, testObject); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != expected.String() {
+		t.Fatalf("output differs:\n%s\n%s", out.String(), expected.String())
+	}
+	if exp := []string{"a", "leave", "b"}; !reflect.DeepEqual(h.seen, exp) {
+		t.Fatalf("%v != %v", h.seen, exp)
+	}
+	if exp := []string{"a", "foo"}; !reflect.DeepEqual(stopped, exp) {
+		t.Fatalf("%v != %v", stopped, exp)
+	}
+}
+
+func TestMultiVisitorSkipAll(t *testing.T) {
+	var a, b strHandler
+	vis := MultiVisitor(NewHandlerVisitor(&a), NewHandlerVisitor(&b))
+	if err := WalkReader(vis, bytes.NewReader(testObject)); err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{"a", "leave", "b"}
+	if !reflect.DeepEqual(a.seen, exp) || !reflect.DeepEqual(b.seen, exp) {
+		t.Fatalf("%v, %v != %v", a.seen, b.seen, exp)
+	}
+}
+
+func TestMultiVisitorReuse(t *testing.T) {
+	var stopped []string
+	h := &strHandler{}
+	stopper := &Visitor{
+		Str: func(ctx *LensContext, bts []byte, str string) error {
+			stopped = append(stopped, str)
+			return ErrStopWalk
+		},
+	}
+	vis := MultiVisitor(NewHandlerVisitor(h), stopper)
+
+	// The first walk fails while h is skipping the array:
+	if err := WalkBytes(vis, []byte{0x81, 0xa1, 'a', 0x92, 0xa1}); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := WalkBytes(vis, testObject); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"a", "a", "leave", "b"}; !reflect.DeepEqual(h.seen, exp) {
+		t.Fatalf("%v != %v", h.seen, exp)
+	}
+	if exp := []string{"a", "a"}; !reflect.DeepEqual(stopped, exp) {
+		t.Fatalf("%v != %v", stopped, exp)
+	}
+}
@@ -0,0 +1,398 @@
+package msgplens
+
+import (
+	"bytes"
+	"math"
+)
+
+// NodePrefix returns the prefix byte of a node. Node can't have a Prefix
+// method, as every node already has a Prefix field.
+func NodePrefix(n Node) byte {
+	return n.common().Prefix
+}
+
+func (c *commonNode) common() *commonNode { return c }
+
+// Type returns the type of the node's prefix.
+func (c *commonNode) Type() Type { return getType(c.Prefix) }
+
+// Len returns the number of elements in an array, entries in a map, or bytes
+// in a str, bin or extension's data. It is zero for other nodes.
+func (c *commonNode) Len() int { return 0 }
+
+// Index returns element i of an array. It returns false for other nodes, or
+// if i is out of range.
+func (c *commonNode) Index(i int) (Node, bool) { return nil, false }
+
+// Get returns the value of the first entry in a map whose key equals key.
+// Keys are compared by value, regardless of encoding width: a string matches
+// a str key, a []byte a bin key, nil a nil key, any Go int or uint type an
+// int or uint key of the same value, and a float32 or float64 a float key of
+// the same value. Ints never match float keys, nor floats int keys. It
+// returns false for other nodes, or if no key matches.
+func (c *commonNode) Get(key interface{}) (Node, bool) { return nil, false }
+
+// AsString returns the value of a str node.
+func (c *commonNode) AsString() (string, bool) { return "", false }
+
+// AsBytes returns the value of a bin node.
+func (c *commonNode) AsBytes() ([]byte, bool) { return nil, false }
+
+// AsInt returns the value of an int node, or of a uint node that fits in an
+// int64. Like AsUint and AsFloat, the value is the one the node encodes, read
+// from its Bits or fixint prefix; Approx is ignored.
+func (c *commonNode) AsInt() (int64, bool) { return 0, false }
+
+// AsUint returns the value of a uint node, or of an int node that isn't
+// negative.
+func (c *commonNode) AsUint() (uint64, bool) { return 0, false }
+
+// AsFloat returns the value of a float32 or float64 node.
+func (c *commonNode) AsFloat() (float64, bool) { return 0, false }
+
+// AsBool returns the value of a bool node.
+func (c *commonNode) AsBool() (bool, bool) { return false, false }
+
+// AsExtension returns the type and data of an extension node.
+func (c *commonNode) AsExtension() (Extension, bool) { return Extension{}, false }
+
+func (a *ArrayNode) Len() int { return len(a.Children) }
+
+func (a *ArrayNode) Index(i int) (Node, bool) {
+	if i < 0 || i >= len(a.Children) {
+		return nil, false
+	}
+	return a.Children[i], true
+}
+
+func (m *MapNode) Len() int { return len(m.Values) }
+
+func (m *MapNode) Get(key interface{}) (Node, bool) {
+	for _, kv := range m.Values {
+		if nodeMatches(kv.Key, key) {
+			return kv.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (s *StrNode) Len() int                 { return len(s.Value) }
+func (s *StrNode) AsString() (string, bool) { return s.Value, true }
+
+func (b *BinNode) Len() int                { return len(b.Value) }
+func (b *BinNode) AsBytes() ([]byte, bool) { return b.Value, true }
+func (b *BoolNode) AsBool() (bool, bool)   { return b.Value, true }
+func (e *ExtensionNode) Len() int          { return len(readExtension(e.Contents).Data) }
+
+func (e *ExtensionNode) AsExtension() (Extension, bool) {
+	return readExtension(e.Contents), true
+}
+
+// AsInt returns the value of a fixint's prefix, or of its Bits cut to the
+// width of its prefix, as Msgpack would write it.
+func (n *IntNode) AsInt() (int64, bool) {
+	switch {
+	case isfixint(n.Prefix):
+		return int64(n.Prefix), true
+	case isnfixint(n.Prefix):
+		return int64(int8(n.Prefix)), true
+	case getType(n.Prefix) != IntType || len(n.Bits) != 8:
+		return 0, false
+	}
+	shift := 64 - 8*(sizes[n.Prefix].size-1)
+	return int64(byteOrder.Uint64(n.Bits)<<shift) >> shift, true
+}
+
+func (n *IntNode) AsUint() (uint64, bool) {
+	i, ok := n.AsInt()
+	if !ok || i < 0 {
+		return 0, false
+	}
+	return uint64(i), true
+}
+
+// AsUint returns the value of a fixint's prefix, or of its Bits cut to the
+// width of its prefix, as Msgpack would write it.
+func (n *UintNode) AsUint() (uint64, bool) {
+	switch {
+	case isfixint(n.Prefix):
+		return uint64(n.Prefix), true
+	case getType(n.Prefix) != UintType || len(n.Bits) != 8:
+		return 0, false
+	}
+	shift := 64 - 8*(sizes[n.Prefix].size-1)
+	return byteOrder.Uint64(n.Bits) << shift >> shift, true
+}
+
+func (n *UintNode) AsInt() (int64, bool) {
+	u, ok := n.AsUint()
+	if !ok || u > math.MaxInt64 {
+		return 0, false
+	}
+	return int64(u), true
+}
+
+func (n *FloatNode) AsFloat() (float64, bool) {
+	switch {
+	case n.Prefix == Float32 && len(n.Bits) == 4:
+		return float64(math.Float32frombits(byteOrder.Uint32(n.Bits))), true
+	case n.Prefix == Float64 && len(n.Bits) == 8:
+		return math.Float64frombits(byteOrder.Uint64(n.Bits)), true
+	}
+	return 0, false
+}
+
+// nodeMatches reports whether n holds the value v, as described by Get.
+func nodeMatches(n Node, v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return n.Type() == NilType
+	case string:
+		s, ok := n.AsString()
+		return ok && s == v
+	case []byte:
+		b, ok := n.AsBytes()
+		return ok && bytes.Equal(b, v)
+	case bool:
+		b, ok := n.AsBool()
+		return ok && b == v
+	case float32:
+		f, ok := n.AsFloat()
+		return ok && f == float64(v)
+	case float64:
+		f, ok := n.AsFloat()
+		return ok && f == v
+	case int:
+		return nodeMatchesInt(n, int64(v))
+	case int8:
+		return nodeMatchesInt(n, int64(v))
+	case int16:
+		return nodeMatchesInt(n, int64(v))
+	case int32:
+		return nodeMatchesInt(n, int64(v))
+	case int64:
+		return nodeMatchesInt(n, v)
+	case uint:
+		return nodeMatchesUint(n, uint64(v))
+	case uint8:
+		return nodeMatchesUint(n, uint64(v))
+	case uint16:
+		return nodeMatchesUint(n, uint64(v))
+	case uint32:
+		return nodeMatchesUint(n, uint64(v))
+	case uint64:
+		return nodeMatchesUint(n, v)
+	}
+	return false
+}
+
+func nodeMatchesInt(n Node, v int64) bool {
+	i, ok := n.AsInt()
+	return ok && i == v
+}
+
+func nodeMatchesUint(n Node, v uint64) bool {
+	u, ok := n.AsUint()
+	return ok && u == v
+}
+
+// Lookup follows path from n, as returned by LensContext.Path: int elements
+// index arrays, MapKey elements select the key of a map entry, and any
+// other element is passed to Get. An empty path returns n itself.
+func Lookup(n Node, path Path) (Node, bool) {
+	for _, e := range path {
+		var ok bool
+		switch e := e.(type) {
+		case int:
+			n, ok = n.Index(e)
+		case MapKey:
+			m, isMap := n.(*MapNode)
+			if ok = isMap && int(e) >= 0 && int(e) < len(m.Values); ok {
+				n = m.Values[e].Key
+			}
+		default:
+			n, ok = n.Get(e)
+		}
+		if !ok {
+			return nil, false
+		}
+	}
+	return n, true
+}
+
+// EqualOptions controls how Equal compares nodes.
+type EqualOptions struct {
+	// IgnoreWidth compares nodes by value rather than by encoding, so an
+	// Int8 and a Uint16 are equal if they hold the same number, a Float32
+	// and a Float64 are equal if they hold the same float64 value, and a
+	// Str8 and a Fixstr are equal if they hold the same string. Map entries
+	// are still compared in order.
+	IgnoreWidth bool
+}
+
+// Equal reports whether a and b encode to exactly the same msgpack. Fields
+// that are informational only, such as Approx, are ignored.
+func Equal(a, b Node) bool {
+	return EqualOptions{}.Equal(a, b)
+}
+
+// Equal reports whether a and b are equal according to the options. Two nil
+// nodes are equal, and a nil node isn't equal to any other.
+func (o EqualOptions) Equal(a, b Node) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if !o.IgnoreWidth {
+		var ab, bb bytes.Buffer
+		if a.Msgpack(&ab) != nil || b.Msgpack(&bb) != nil {
+			return false
+		}
+		return bytes.Equal(ab.Bytes(), bb.Bytes())
+	}
+
+	switch a.Type() {
+	case IntType, UintType:
+		if ai, ok := a.AsInt(); ok {
+			return nodeMatchesInt(b, ai)
+		}
+		au, ok := a.AsUint()
+		return ok && nodeMatchesUint(b, au)
+
+	case Float32Type, Float64Type:
+		af, aok := a.AsFloat()
+		bf, bok := b.AsFloat()
+		return aok && bok && (af == bf || (math.IsNaN(af) && math.IsNaN(bf)))
+
+	case ArrayType:
+		if b.Type() != ArrayType || a.Len() != b.Len() {
+			return false
+		}
+		for i := 0; i < a.Len(); i++ {
+			ac, _ := a.Index(i)
+			bc, _ := b.Index(i)
+			if !o.Equal(ac, bc) {
+				return false
+			}
+		}
+		return true
+
+	case MapType:
+		am := a.(*MapNode)
+		bm, ok := b.(*MapNode)
+		if !ok || len(am.Values) != len(bm.Values) {
+			return false
+		}
+		for i := range am.Values {
+			if !o.Equal(am.Values[i].Key, bm.Values[i].Key) || !o.Equal(am.Values[i].Value, bm.Values[i].Value) {
+				return false
+			}
+		}
+		return true
+
+	case ExtensionType:
+		ae, _ := a.AsExtension()
+		be, ok := b.AsExtension()
+		return ok && ae.Type == be.Type && bytes.Equal(ae.Data, be.Data)
+
+	case StrType:
+		as, _ := a.AsString()
+		return nodeMatches(b, as)
+
+	case BinType:
+		ab, _ := a.AsBytes()
+		return nodeMatches(b, ab)
+
+	case BoolType:
+		av, _ := a.AsBool()
+		return nodeMatches(b, av)
+
+	case NilType:
+		return b.Type() == NilType
+	}
+	return false
+}
+
+// Clone returns a deep copy of the node, which shares no memory with the
+// original.
+func (n *NilNode) Clone() Node {
+	c := *n
+	return &c
+}
+
+func (n *BoolNode) Clone() Node {
+	c := *n
+	return &c
+}
+
+func (n *IntNode) Clone() Node {
+	c := *n
+	c.Bits = cloneBytes(n.Bits)
+	return &c
+}
+
+func (n *UintNode) Clone() Node {
+	c := *n
+	c.Bits = cloneBytes(n.Bits)
+	return &c
+}
+
+func (n *FloatNode) Clone() Node {
+	c := *n
+	c.Bits = cloneBytes(n.Bits)
+	return &c
+}
+
+func (n *StrNode) Clone() Node {
+	c := *n
+	return &c
+}
+
+func (n *BinNode) Clone() Node {
+	c := *n
+	c.Value = cloneBytes(n.Value)
+	return &c
+}
+
+// Clone copies everything but Value, which is informational only, and is
+// shared with the original.
+func (n *ExtensionNode) Clone() Node {
+	c := *n
+	c.Contents = cloneBytes(n.Contents)
+	c.Document = cloneNodes(n.Document)
+	return &c
+}
+
+func (n *ArrayNode) Clone() Node {
+	c := *n
+	c.Children = cloneNodes(n.Children)
+	return &c
+}
+
+func (n *MapNode) Clone() Node {
+	c := *n
+	if n.Values != nil {
+		c.Values = make([]KeyValueNode, len(n.Values))
+		for i, kv := range n.Values {
+			c.Values[i] = KeyValueNode{Key: kv.Key.Clone(), Value: kv.Value.Clone()}
+		}
+	}
+	return &c
+}
+
+func cloneNodes(nodes NodeList) NodeList {
+	if nodes == nil {
+		return nil
+	}
+	out := make(NodeList, len(nodes))
+	for i, n := range nodes {
+		out[i] = n.Clone()
+	}
+	return out
+}
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
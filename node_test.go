@@ -0,0 +1,146 @@
+package msgplens
+
+import (
+	"testing"
+)
+
+func reprNode(t *testing.T, in []byte) Node {
+	t.Helper()
+	repr := NewRepresenter()
+	if err := WalkBytes(repr, in); err != nil {
+		t.Fatal(err)
+	}
+	return repr.Nodes()[0]
+}
+
+func TestNodeAccessors(t *testing.T) {
+	// {"a": [1, -1, 200 as Uint16], 2: "xy", nil: bin(0x01), 1.5: ext(5, "y")}
+	n := reprNode(t, []byte{
+		0x84,
+		0xa1, 'a', 0x93, 0x01, 0xff, Uint16, 0x00, 0xc8,
+		0x02, 0xa2, 'x', 'y',
+		Nil, Bin8, 0x01, 0x01,
+		Float32, 0x3f, 0xc0, 0x00, 0x00, Fixext1, 0x05, 'y',
+	})
+	if n.Type() != MapType || n.Len() != 4 || NodePrefix(n) != 0x84 {
+		t.Fatal(n.Type(), n.Len(), NodePrefix(n))
+	}
+
+	arr, ok := n.Get("a")
+	if !ok || arr.Type() != ArrayType || arr.Len() != 3 {
+		t.Fatal("a", ok)
+	}
+	if _, ok := arr.Index(3); ok {
+		t.Fatal("index out of range")
+	}
+	if v, ok := arr.Index(1); !ok {
+		t.Fatal("index 1")
+	} else if i, ok := v.AsInt(); !ok || i != -1 {
+		t.Fatal(i, ok)
+	} else if _, ok := v.AsUint(); ok {
+		t.Fatal("negative int as uint")
+	}
+	if v, _ := arr.Index(2); NodePrefix(v) != Uint16 {
+		t.Fatal(NodePrefix(v))
+	} else if i, ok := v.AsInt(); !ok || i != 200 {
+		t.Fatal(i, ok)
+	}
+
+	if v, ok := n.Get(uint8(2)); !ok {
+		t.Fatal("2")
+	} else if s, ok := v.AsString(); !ok || s != "xy" || v.Len() != 2 {
+		t.Fatal(s, ok)
+	}
+	if v, ok := n.Get(nil); !ok {
+		t.Fatal("nil")
+	} else if b, ok := v.AsBytes(); !ok || string(b) != "\x01" {
+		t.Fatal(b, ok)
+	}
+	if v, ok := n.Get(1.5); !ok {
+		t.Fatal("1.5")
+	} else if e, ok := v.AsExtension(); !ok || e.Type != 5 || string(e.Data) != "y" || v.Len() != 1 {
+		t.Fatal(e, ok)
+	}
+	if _, ok := n.Get("b"); ok {
+		t.Fatal("b")
+	}
+	if _, ok := n.Get(2.0); ok {
+		t.Fatal("float matched int key")
+	}
+
+	if v, ok := Lookup(n, Path{"a", 2}); !ok {
+		t.Fatal("lookup")
+	} else if u, ok := v.AsUint(); !ok || u != 200 {
+		t.Fatal(u, ok)
+	}
+	if v, ok := Lookup(n, Path{MapKey(1)}); !ok {
+		t.Fatal("lookup key")
+	} else if i, _ := v.AsInt(); i != 2 {
+		t.Fatal(i)
+	}
+	if _, ok := Lookup(n, Path{"a", 0, 0}); ok {
+		t.Fatal("lookup into int")
+	}
+}
+
+func TestNodeEqual(t *testing.T) {
+	// [1, 1.5 as Float64, "a"] against [1 as Int16, 1.5 as Float32, "a" as Str8]
+	a := reprNode(t, []byte{0x93, 0x01, Float64, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0, 0xa1, 'a'})
+	b := reprNode(t, []byte{0x93, Int16, 0x00, 0x01, Float32, 0x3f, 0xc0, 0x00, 0x00, Str8, 0x01, 'a'})
+
+	if !Equal(a, a.Clone()) {
+		t.Fatal("clone not equal")
+	}
+	if Equal(a, b) {
+		t.Fatal("different widths equal")
+	}
+	if !(EqualOptions{IgnoreWidth: true}).Equal(a, b) {
+		t.Fatal("same values not equal")
+	}
+
+	c := reprNode(t, []byte{0x93, 0x02, Float64, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0, 0xa1, 'a'})
+	if (EqualOptions{IgnoreWidth: true}).Equal(a, c) {
+		t.Fatal("different values equal")
+	}
+
+	// The value is read from the Bits that are encoded, whatever Approx says:
+	d := b.Clone()
+	i, _ := d.Index(0)
+	i.(*IntNode).Bits[0] = 0xff
+	if !(EqualOptions{IgnoreWidth: true}).Equal(a, d) || !Equal(b, d) {
+		t.Fatal("bits beyond Int16 not ignored")
+	}
+	i.(*IntNode).Bits[7] = 2
+	if (EqualOptions{IgnoreWidth: true}).Equal(a, d) || Equal(b, d) {
+		t.Fatal("changed bits equal")
+	}
+	if v, _ := i.AsInt(); v != 2 {
+		t.Fatal(v)
+	}
+
+	for _, o := range []EqualOptions{{}, {IgnoreWidth: true}} {
+		if !o.Equal(nil, nil) || o.Equal(a, nil) || o.Equal(nil, a) {
+			t.Fatal("nil", o)
+		}
+	}
+}
+
+func TestNodeClone(t *testing.T) {
+	n := reprNode(t, []byte{0x92, Bin8, 0x01, 0x01, Uint16, 0x00, 0xc8})
+	c := n.Clone()
+
+	bin, _ := c.Index(0)
+	bin.(*BinNode).Value[0] = 2
+	u, _ := c.Index(1)
+	u.(*UintNode).Bits[7] = 0
+
+	if b, _ := Lookup(n, Path{0}); b.(*BinNode).Value[0] != 1 {
+		t.Fatal("bin shared with clone")
+	}
+	if v, _ := Lookup(n, Path{1}); v.(*UintNode).Bits[7] != 0xc8 {
+		t.Fatal("bits shared with clone")
+	}
+	if v, _ := u.AsUint(); v != 0 {
+		t.Fatal("clone value not read from bits", v)
+	}
+}
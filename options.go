@@ -0,0 +1,77 @@
+package msgplens
+
+import "io"
+
+// WalkOptions limits the resources a walk may use, so that untrusted input
+// can't exhaust the stack or run for an unreasonable amount of time. A zero
+// value for any limit means it is not enforced.
+type WalkOptions struct {
+	// MaxDepth is the maximum number of nested arrays and maps. A msgpack
+	// document nested in an extension, such as one decoded with
+	// DecodeMsgpackExt, counts as a level of its own.
+	MaxDepth int
+
+	// MaxContainerLen is the maximum number of elements in any one array, or
+	// entries in any one map.
+	MaxContainerLen int
+
+	// MaxElements is the maximum number of objects in the input, including
+	// containers and their children, whether they are visited or skipped,
+	// and the objects in any msgpack documents nested in extensions.
+	MaxElements int
+
+	// Strict rejects arrays and maps that claim more children than there are
+	// bytes left in the input before any of the children are walked. It has
+	// no effect when walking a reader, as the input length isn't known.
+	Strict bool
+}
+
+// DefaultWalkOptions are used by WalkBytes, WalkAllBytes, WalkReader and
+// WalkAllReader. The default depth limit protects against stack exhaustion;
+// the other limits should be set when walking untrusted input.
+var DefaultWalkOptions = WalkOptions{
+	MaxDepth: 10000,
+	Strict:   true,
+}
+
+// WalkBytes is equivalent to the package level WalkBytes, using these
+// options.
+func (o WalkOptions) WalkBytes(v Visitable, bts []byte) error {
+	ctx := &LensContext{
+		cursor: cursor{opts: o, src: &bytesSource{bts: bts}},
+		vis:    v.Visitor(),
+	}
+	return ctx.walkRoot()
+}
+
+// WalkAllBytes is equivalent to the package level WalkAllBytes, using these
+// options.
+func (o WalkOptions) WalkAllBytes(v Visitable, bts []byte) error {
+	ctx := &LensContext{
+		cursor: cursor{opts: o, src: &bytesSource{bts: bts}},
+		vis:    v.Visitor(),
+		multi:  true,
+	}
+	return ctx.walkRoot()
+}
+
+// WalkReader is equivalent to the package level WalkReader, using these
+// options.
+func (o WalkOptions) WalkReader(v Visitable, rdr io.Reader) error {
+	ctx := &LensContext{
+		cursor: cursor{opts: o, src: newReaderSource(rdr)},
+		vis:    v.Visitor(),
+	}
+	return ctx.walkRoot()
+}
+
+// WalkAllReader is equivalent to the package level WalkAllReader, using
+// these options.
+func (o WalkOptions) WalkAllReader(v Visitable, rdr io.Reader) error {
+	ctx := &LensContext{
+		cursor: cursor{opts: o, src: newReaderSource(rdr)},
+		vis:    v.Visitor(),
+		multi:  true,
+	}
+	return ctx.walkRoot()
+}
@@ -0,0 +1,49 @@
+package msgplens
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Path is the location of a value inside a msgpack object. Each element is
+// either an int for an array index, the decoded key of a map entry (string,
+// int64, uint64, float32, float64, bool, []byte or nil), or a MapKey when
+// the path points at a map key rather than its value.
+type Path []interface{}
+
+// MapKey is the Path element used while a map key is being walked, as the
+// key itself is not known until it has been decoded. It is also used for
+// keys that can't be represented as a simple value, like arrays. It holds
+// the index of the entry in the map.
+type MapKey int
+
+// String returns the path as a JSON pointer (RFC 6901), i.e.
+// "/users/3/name". MapKey elements are rendered as "(key N)".
+func (p Path) String() string {
+	var sb strings.Builder
+	for _, e := range p {
+		sb.WriteByte('/')
+		sb.WriteString(pathElemString(e))
+	}
+	return sb.String()
+}
+
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+func pathElemString(e interface{}) string {
+	switch e := e.(type) {
+	case int:
+		return strconv.Itoa(e)
+	case MapKey:
+		return fmt.Sprintf("(key %d)", int(e))
+	case string:
+		return pointerEscaper.Replace(e)
+	case []byte:
+		return pointerEscaper.Replace(string(e))
+	case nil:
+		return "null"
+	default:
+		return pointerEscaper.Replace(fmt.Sprint(e))
+	}
+}
@@ -6,118 +6,341 @@ import (
 	"fmt"
 	"io"
 	"regexp"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 const (
-	styleKeyLen         = 4
-	styleTypeLen        = 8
-	styleAttrNameLen    = 4
-	styleAttrValueLen   = 4
-	styleAttrNameColor  = darkGray
-	styleAttrValueColor = lightGray
-	styleKeyIndexColor  = lightMagenta
-	styleKeyTypeColor   = magenta
-	styleIntColor       = green
-	styleFloatColor     = yellow
-	styleStringColor    = lightBlue
+	styleKeyLen       = 4
+	styleTypeLen      = 8
+	styleAttrNameLen  = 4
+	styleAttrValueLen = 4
+	stylePathLen      = 24
 )
 
+// PrinterOptions controls the output of a Printer.
+type PrinterOptions struct {
+	// Color controls whether output is colored. The zero value, ColorAuto,
+	// colors output only if it is written to a terminal and the NO_COLOR
+	// environment variable is not set.
+	Color ColorMode
+
+	// Theme is the palette used for colored output. If nil, ThemeDark is
+	// used.
+	Theme *Theme
+
+	// MaxBytes limits how many bytes of each Str, Bin or undecoded Extension
+	// are shown. If zero, strings are shown in full, and at most 256 bytes of
+	// Bin and Extension payloads are shown.
+	MaxBytes int
+
+	// MaxElements limits how many elements of each array or entries of each
+	// map are shown. The first and last few are shown, with a count of those
+	// skipped in between. If zero, there is no limit.
+	MaxElements int
+
+	// MaxDepth is the depth beyond which arrays and maps are collapsed to a
+	// single line showing their length and total size. A MaxDepth of 1 shows
+	// the contents of a top level container, but collapses any containers
+	// inside it. If zero, there is no limit.
+	MaxDepth int
+
+	// Compact prints each map entry whose key fits on one line as a single
+	// line, such as `"name" (Fixstr@12) => "bob" (Fixstr@17)`, instead of
+	// separate K and V lines. Entries with other keys, such as arrays, keep
+	// the full layout.
+	Compact bool
+
+	// HexOffsets prints offsets in hex instead of decimal.
+	HexOffsets bool
+
+	// RelativeOffsets prints the offset of each object relative to the start
+	// of the array or map containing it, or of its top level object.
+	RelativeOffsets bool
+
+	// ShowEnd prints the offset just past the end of each object after its
+	// size. For arrays and maps, like the size, it covers only the header.
+	ShowEnd bool
+
+	// ShowPath prints the path of each object, as a JSON pointer, in a
+	// column on the left.
+	ShowPath bool
+}
+
 type Printer struct {
-	vis *Visitor
-	out io.Writer
-	w   *writer
+	vis   *Visitor
+	out   io.Writer
+	w     *writer
+	opts  PrinterOptions
+	theme Theme
+	ctx   *LensContext
+
+	// collapsed is the offset of the container being collapsed because it
+	// is deeper than MaxDepth.
+	collapsed int
+
+	// State of the map entry being printed in compact form. keyPending is
+	// set when nothing has been printed for key keyIndex yet, inlineKey once
+	// the key has been printed inline, and inlineVal while its value may be.
+	keyPending bool
+	keyIndex   int
+	inlineKey  bool
+	inlineVal  bool
 
 	AllowExtra bool
+
+	// Extensions decodes extension objects. If nil, DefaultExtRegistry is
+	// used.
+	Extensions *ExtRegistry
+}
+
+// printDocument prints a msgpack document found inside an extension,
+// indented beneath it.
+func (p *Printer) printDocument(ctx *LensContext, bts []byte) error {
+	sub := NewPrinterWithOptions(p.out, p.opts)
+	sub.w = p.w
+	sub.theme = p.theme
+	sub.Extensions = p.Extensions
+
+	p.w.depth++
+	defer func() { p.w.depth-- }()
+	return ctx.walkNested(sub, bts)
 }
 
 func (p *Printer) printType(ctx *LensContext, prefix byte, size int) {
-	p.w.writef("%s%[2]*s",
-		colorw(styleAttrNameColor, "at:"),
-		styleAttrValueLen, colorw(styleAttrValueColor, ctx.Pos()))
-	p.w.writef("%s%[2]*s",
-		colorw(styleAttrNameColor, "sz:"),
-		styleAttrValueLen, colorw(styleAttrValueColor, size))
-
-	p.w.write(color(lightCyan, fmt.Sprintf("0x%02x (%03d) ", prefix, prefix)))
-	p.w.writef("%[1]*s", styleTypeLen, colorw(cyan, prefixName(prefix)))
+	p.printTypeAt(ctx, ctx.Pos(), prefix, size)
+}
+
+func (p *Printer) printTypeAt(ctx *LensContext, pos int, prefix byte, size int) {
+	p.printAttr("at:", p.offset(ctx, pos))
+	p.printAttr("sz:", size)
+	if p.opts.ShowEnd {
+		p.printAttr("end:", p.offset(ctx, pos+size))
+	}
+
+	p.w.write(color(p.theme.Prefix, fmt.Sprintf("0x%02x (%03d) ", prefix, prefix)))
+	p.w.writef("%[1]*s", styleTypeLen, colorw(p.theme.Type, prefixName(prefix)))
 	p.w.write(" ")
 }
 
+// printAttr writes an attribute padded to a fixed width, followed by at least
+// one space.
+func (p *Printer) printAttr(name string, value interface{}) {
+	v := colorw(p.theme.AttrValue, value)
+	p.w.writef("%s%[2]*s", colorw(p.theme.AttrName, name), styleAttrValueLen, v)
+	if v.len >= styleAttrValueLen {
+		p.w.write(" ")
+	}
+}
+
+// offset formats an absolute offset as PrinterOptions asks.
+func (p *Printer) offset(ctx *LensContext, pos int) string {
+	if p.opts.RelativeOffsets {
+		if n := len(ctx.stack); n > 0 {
+			pos -= ctx.stack[n-1].start
+		} else {
+			pos -= ctx.RootPos()
+		}
+	}
+	if p.opts.HexOffsets {
+		return fmt.Sprintf("0x%x", pos)
+	}
+	return strconv.Itoa(pos)
+}
+
+// printPath writes the path column at the start of a line.
+func (p *Printer) printPath() {
+	var path Path
+	if p.ctx != nil {
+		path = p.ctx.Path()
+		if n := len(path); n > 0 && p.inlineKey {
+			// A key printed in compact form starts the line for its value.
+			if f := &p.ctx.stack[n-1]; f.keySet {
+				path[n-1] = f.key
+			}
+		}
+	}
+	p.w.WriteString(colorPadRight(p.theme.AttrValue, path, stylePathLen, ' '))
+	p.w.WriteString(" ")
+}
+
 func (p *Printer) Flush() error {
 	return p.w.Flush()
 }
 
+// NewPrinter returns a Printer that writes colored output to out, whether or
+// not it is a terminal. Use NewPrinterWithOptions to color output only when
+// it is written to a terminal.
 func NewPrinter(out io.Writer) *Printer {
+	return NewPrinterWithOptions(out, PrinterOptions{Color: ColorAlways})
+}
+
+// NewPrinterWithOptions returns a Printer that writes to out. Unlike
+// NewPrinter, its output is colored only as opts.Color allows, which by
+// default is when out is a terminal.
+func NewPrinterWithOptions(out io.Writer, opts PrinterOptions) *Printer {
 	p := &Printer{
 		out: out,
 		w: &writer{
 			Writer: bufio.NewWriter(out),
 			indent: "  ",
 		},
+		opts: opts,
+	}
+	if opts.Color.enabled(out) {
+		p.theme = ThemeDark
+		if opts.Theme != nil {
+			p.theme = *opts.Theme
+		}
+	}
+	if opts.ShowPath {
+		p.w.lineStart = p.printPath
 	}
 	p.vis = &Visitor{
+		Begin: func(ctx *LensContext) error {
+			p.ctx = ctx
+			return nil
+		},
+
+		EnterRoot: func(ctx *LensContext, n int) error {
+			if ctx.multi {
+				if n > 0 {
+					p.w.writeln()
+				}
+				p.w.writef("%s%s ", colorw(p.theme.AttrName, "#"), colorw(p.theme.KeyIndex, n))
+				p.w.writef("%s%s", colorw(p.theme.AttrName, "at:"), colorw(p.theme.AttrValue, p.offset(ctx, ctx.RootPos())))
+				p.w.writeln()
+			}
+			return nil
+		},
+
 		Str: func(ctx *LensContext, bts []byte, str string) error {
-			p.printType(ctx, bts[0], len(bts))
-			p.w.write(color(styleStringColor, fmt.Sprintf("%q", str)))
-			p.w.writeln()
+			shown := truncateString(str, p.opts.MaxBytes)
+			p.printScalar(ctx, bts[0], len(bts),
+				color(p.theme.String, fmt.Sprintf("%q", shown))+p.more(len(str)-len(shown)))
 			return nil
 		},
 
 		Int: func(ctx *LensContext, bts []byte, data int64) error {
-			p.printType(ctx, bts[0], len(bts))
-			p.w.writef("%d", colorw(styleIntColor, data))
-			p.w.writeln()
+			p.printScalar(ctx, bts[0], len(bts), color(p.theme.Int, data))
 			return nil
 		},
 
 		Uint: func(ctx *LensContext, bts []byte, data uint64) error {
-			p.printType(ctx, bts[0], len(bts))
-			p.w.writef("%d", colorw(styleIntColor, data))
-			p.w.writeln()
+			p.printScalar(ctx, bts[0], len(bts), color(p.theme.Int, data))
 			return nil
 		},
 
 		Bin: func(ctx *LensContext, bts []byte, data []byte) error {
+			p.inline(false)
 			p.printType(ctx, bts[0], len(bts))
-			p.w.writeln(prefixName(bts[0]))
+			p.w.writeln(color(p.theme.AttrName, "len:"), color(p.theme.AttrValue, len(data)))
+			p.w.depth++
+			p.printHexPreview(data, len(data))
+			p.w.depth--
+			return nil
+		},
+
+		StrStream: func(ctx *LensContext, prefix byte, size int, rdr io.Reader) error {
+			p.inline(false)
+			p.printType(ctx, prefix, headerSize(prefix)+size)
+			shown := size
+			if p.opts.MaxBytes > 0 && size > p.opts.MaxBytes {
+				shown = p.opts.MaxBytes
+			}
+			p.w.write(colorStart(p.theme.String))
+			if err := p.w.writeQuoted(io.LimitReader(rdr, int64(shown))); err != nil {
+				return err
+			}
+			p.w.write(colorEnd(p.theme.String))
+			p.w.writeln(p.more(size - shown))
+			return nil
+		},
+
+		BinStream: func(ctx *LensContext, prefix byte, size int, rdr io.Reader) error {
+			p.inline(false)
+			p.printType(ctx, prefix, headerSize(prefix)+size)
+			p.w.writeln(color(p.theme.AttrName, "len:"), color(p.theme.AttrValue, size))
+
+			shown := size
+			if max := p.previewLen(); shown > max {
+				shown = max
+			}
+			data := make([]byte, shown)
+			if _, err := io.ReadFull(rdr, data); err != nil {
+				return err
+			}
+			p.w.depth++
+			p.printHexPreview(data, size)
+			p.w.depth--
 			return nil
 		},
 
 		Float64: func(ctx *LensContext, bts []byte, data float64) error {
-			p.printType(ctx, bts[0], len(bts))
-			p.w.write(color(styleFloatColor, fmt.Sprintf("%g", data)))
-			p.w.writeln()
+			p.printScalar(ctx, bts[0], len(bts), color(p.theme.Float, fmt.Sprintf("%g", data)))
 			return nil
 		},
 
 		Float32: func(ctx *LensContext, bts []byte, data float32) error {
-			p.printType(ctx, bts[0], len(bts))
-			p.w.write(color(styleFloatColor, fmt.Sprintf("%g", data)))
-			p.w.writeln()
+			p.printScalar(ctx, bts[0], len(bts), color(p.theme.Float, fmt.Sprintf("%g", data)))
 			return nil
 		},
 
 		Bool: func(ctx *LensContext, bts []byte, data bool) error {
+			if p.inline(true) {
+				p.printInline(ctx, bts[0], color(p.theme.AttrValue, data))
+				return nil
+			}
 			p.printType(ctx, bts[0], len(bts))
 			p.w.writeln()
 			return nil
 		},
 
 		Nil: func(ctx *LensContext, prefix byte) error {
+			if p.inline(true) {
+				p.printInline(ctx, prefix, color(p.theme.AttrValue, "nil"))
+				return nil
+			}
 			p.printType(ctx, prefix, 1)
 			p.w.writeln()
 			return nil
 		},
 
 		Extension: func(ctx *LensContext, bts []byte) error {
-			p.w.writeln(prefixName(bts[0]))
+			p.inline(false)
+			p.printType(ctx, bts[0], len(bts))
+			ext := readExtension(bts)
+			p.w.write(color(p.theme.AttrName, "type:"), color(p.theme.AttrValue, ext.Type), " ")
+			p.w.write(color(p.theme.AttrName, "len:"), color(p.theme.AttrValue, len(ext.Data)))
+			v, ok, err := p.Extensions.orDefault().Decode(ext)
+			if err != nil {
+				p.w.write(" ", color(p.theme.Error, err))
+			} else if ok && v.Display != "" {
+				p.w.write(" ", color(p.theme.Ext, v.Display))
+			}
+			p.w.writeln()
+
+			if ok && err == nil {
+				if v.Msgpack != nil {
+					return p.printDocument(ctx, v.Msgpack)
+				}
+			} else {
+				p.w.depth++
+				p.printHexPreview(ext.Data, len(ext.Data))
+				p.w.depth--
+			}
 			return nil
 		},
 
 		EnterArray: func(ctx *LensContext, prefix byte, cnt int) error {
-			p.printType(ctx, prefix, 1)
-			p.w.write(color(styleAttrNameColor, "len:"), color(styleAttrValueColor, cnt))
+			p.inline(false)
+			if p.collapse(ctx) {
+				p.collapsed = ctx.Pos()
+				return ErrSkipChildren
+			}
+			p.printType(ctx, prefix, headerSize(prefix))
+			p.w.write(color(p.theme.AttrName, "len:"), color(p.theme.AttrValue, cnt))
 			p.w.write(" [")
 			if cnt > 0 {
 				p.w.writeln()
@@ -127,7 +350,10 @@ func NewPrinter(out io.Writer) *Printer {
 		},
 
 		EnterArrayElem: func(ctx *LensContext, n, cnt int) error {
-			p.w.writef("%[1]*s", styleKeyLen, colorw(styleKeyIndexColor, n))
+			if p.skipElem(n, cnt, "elements") {
+				return ErrSkipChildren
+			}
+			p.w.writef("%[1]*s", styleKeyLen, colorw(p.theme.KeyIndex, n))
 			return nil
 		},
 
@@ -136,14 +362,23 @@ func NewPrinter(out io.Writer) *Printer {
 		},
 
 		LeaveArray: func(ctx *LensContext, prefix byte, cnt int, bts []byte) error {
+			if p.collapse(ctx) {
+				p.printCollapsed(ctx, prefix, cnt, "[…]")
+				return nil
+			}
 			p.w.depth--
 			p.w.writeln("]")
 			return nil
 		},
 
 		EnterMap: func(ctx *LensContext, prefix byte, cnt int) error {
-			p.printType(ctx, prefix, 1)
-			p.w.write(color(styleAttrNameColor, "len:"), color(styleAttrValueColor, cnt))
+			p.inline(false)
+			if p.collapse(ctx) {
+				p.collapsed = ctx.Pos()
+				return ErrSkipChildren
+			}
+			p.printType(ctx, prefix, headerSize(prefix))
+			p.w.write(color(p.theme.AttrName, "len:"), color(p.theme.AttrValue, cnt))
 			p.w.write(" {")
 			if cnt > 0 {
 				p.w.writeln()
@@ -153,7 +388,14 @@ func NewPrinter(out io.Writer) *Printer {
 		},
 
 		EnterMapKey: func(ctx *LensContext, n, cnt int) error {
-			p.w.writef("%[1]*s", styleKeyLen, colorw(styleKeyTypeColor, "K").Append(styleKeyIndexColor, n))
+			if p.skipElem(n, cnt, "entries") {
+				return ErrSkipChildren
+			}
+			if p.opts.Compact {
+				p.keyPending, p.keyIndex = true, n
+				return nil
+			}
+			p.w.writef("%[1]*s", styleKeyLen, colorw(p.theme.KeyType, "K").Append(p.theme.KeyIndex, n))
 			return nil
 		},
 
@@ -162,7 +404,15 @@ func NewPrinter(out io.Writer) *Printer {
 		},
 
 		EnterMapElem: func(ctx *LensContext, n, cnt int) error {
-			p.w.writef("%[1]*s", styleKeyLen, colorw(styleKeyTypeColor, "V").Append(styleKeyIndexColor, n))
+			if p.elemHidden(n, cnt) {
+				return ErrSkipChildren
+			}
+			if p.inlineKey {
+				p.w.write(color(p.theme.AttrName, " => "))
+				p.inlineKey, p.inlineVal = false, true
+				return nil
+			}
+			p.w.writef("%[1]*s", styleKeyLen, colorw(p.theme.KeyType, "V").Append(p.theme.KeyIndex, n))
 			return nil
 		},
 
@@ -171,6 +421,10 @@ func NewPrinter(out io.Writer) *Printer {
 		},
 
 		LeaveMap: func(ctx *LensContext, prefix byte, cnt int, bts []byte) error {
+			if p.collapse(ctx) {
+				p.printCollapsed(ctx, prefix, cnt, "{…}")
+				return nil
+			}
 			p.w.depth--
 			p.w.writeln("}")
 			return nil
@@ -216,12 +470,19 @@ type writer struct {
 	depth       int
 	indent      string
 	curIndented bool
+
+	// lineStart, if set, is called to write a column before the
+	// indentation of each line.
+	lineStart func()
 }
 
 func (w *writer) writeIndent() {
 	if !w.curIndented {
-		w.WriteString(strings.Repeat(w.indent, w.depth))
 		w.curIndented = true
+		if w.lineStart != nil {
+			w.lineStart()
+		}
+		w.WriteString(strings.Repeat(w.indent, w.depth))
 	}
 }
 
@@ -265,6 +526,203 @@ func (w *writer) writelnf(line string, args ...interface{}) {
 	w.writeln()
 }
 
+// writeQuoted writes the contents of rdr as a Go-quoted string without
+// holding more than a small chunk of it in memory. The output is identical to
+// what %q produces for the whole string.
+func (w *writer) writeQuoted(rdr io.Reader) error {
+	var buf [4096]byte
+	var carry int
+
+	w.write(`"`)
+	for {
+		n, err := rdr.Read(buf[carry:])
+		n += carry
+		carry = 0
+
+		chunk := buf[:n]
+		if err == nil {
+			// Hold back an incomplete rune at the end of the chunk so it isn't
+			// quoted as a run of invalid bytes.
+			for i := 1; i <= utf8.UTFMax && i <= len(chunk); i++ {
+				if utf8.RuneStart(chunk[len(chunk)-i]) {
+					if !utf8.FullRune(chunk[len(chunk)-i:]) {
+						carry = i
+					}
+					break
+				}
+			}
+			chunk = chunk[:len(chunk)-carry]
+		}
+
+		quoted := strconv.Quote(string(chunk))
+		w.write(quoted[1 : len(quoted)-1])
+		copy(buf[:], buf[len(chunk):n])
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	w.write(`"`)
+	return nil
+}
+
+// defaultPreviewLen is the most bytes of a Bin or Extension payload that
+// Printer shows if PrinterOptions.MaxBytes is not set.
+const defaultPreviewLen = 256
+
+func (p *Printer) previewLen() int {
+	if p.opts.MaxBytes > 0 {
+		return p.opts.MaxBytes
+	}
+	return defaultPreviewLen
+}
+
+// more returns a marker for n bytes that were not shown.
+func (p *Printer) more(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return " " + color(p.theme.AttrName, fmt.Sprintf("… %d more bytes", n))
+}
+
+// inline is called before printing an object. It reports whether the object
+// is a map key or value to be printed inline in compact form, which is only
+// possible if the object fits on one line. A map key that doesn't gets the
+// full layout, and its K marker is written instead.
+func (p *Printer) inline(fits bool) bool {
+	if p.keyPending {
+		p.keyPending = false
+		if fits {
+			p.inlineKey = true
+			return true
+		}
+		p.w.writef("%[1]*s", styleKeyLen, colorw(p.theme.KeyType, "K").Append(p.theme.KeyIndex, p.keyIndex))
+		return false
+	}
+	if p.inlineVal {
+		p.inlineVal = false
+		return fits
+	}
+	return false
+}
+
+// printScalar prints an object that fits on one line, with val as its
+// rendered value.
+func (p *Printer) printScalar(ctx *LensContext, prefix byte, size int, val string) {
+	if p.inline(true) {
+		p.printInline(ctx, prefix, val)
+		return
+	}
+	p.printType(ctx, prefix, size)
+	p.w.write(val)
+	p.w.writeln()
+}
+
+// printInline prints a map key or value in compact form, such as
+// `"bob" (Fixstr@17)`. The line is ended after a value.
+func (p *Printer) printInline(ctx *LensContext, prefix byte, val string) {
+	p.w.write(val, " ",
+		color(p.theme.AttrName, "("), color(p.theme.Type, prefixName(prefix)),
+		color(p.theme.AttrName, "@"), color(p.theme.AttrValue, p.offset(ctx, ctx.Pos())),
+		color(p.theme.AttrName, ")"))
+	if !p.inlineKey {
+		p.w.writeln()
+	}
+}
+
+// collapse reports whether the container being entered or left is deeper
+// than MaxDepth.
+func (p *Printer) collapse(ctx *LensContext) bool {
+	return p.opts.MaxDepth > 0 && ctx.Depth() >= p.opts.MaxDepth
+}
+
+func (p *Printer) printCollapsed(ctx *LensContext, prefix byte, cnt int, body string) {
+	p.printTypeAt(ctx, p.collapsed, prefix, ctx.src.pos()-p.collapsed)
+	p.w.write(color(p.theme.AttrName, "len:"), color(p.theme.AttrValue, cnt))
+	p.w.writeln(" ", body)
+}
+
+// elemHidden reports whether element n of cnt is left out by MaxElements.
+func (p *Printer) elemHidden(n, cnt int) bool {
+	max := p.opts.MaxElements
+	if max <= 0 || cnt <= max {
+		return false
+	}
+	head, tail := (max+1)/2, max/2
+	return n >= head && n < cnt-tail
+}
+
+// skipElem reports whether element n of cnt is left out by MaxElements,
+// printing a count of the skipped elements in place of the first of them.
+func (p *Printer) skipElem(n, cnt int, noun string) bool {
+	if !p.elemHidden(n, cnt) {
+		return false
+	}
+	if n == (p.opts.MaxElements+1)/2 {
+		skipped := cnt - p.opts.MaxElements
+		p.w.writef("%[1]*s", styleKeyLen, colorw(p.theme.KeyIndex, "…"))
+		p.w.writeln(color(p.theme.AttrName, fmt.Sprintf("%d more %s", skipped, noun)))
+	}
+	return true
+}
+
+// printHexPreview writes the first bytes of a payload as lines of hex and
+// ASCII, followed by a count of the size-len(data) bytes that were left out.
+func (p *Printer) printHexPreview(data []byte, size int) {
+	w := p.w
+	show := data
+	if max := p.previewLen(); len(show) > max {
+		show = show[:max]
+	}
+	for i := 0; i < len(show); i += 16 {
+		line := show[i:]
+		if len(line) > 16 {
+			line = line[:16]
+		}
+		w.write(color(p.theme.AttrName, fmt.Sprintf("%04x ", i)))
+
+		var hex, ascii strings.Builder
+		for j := 0; j < 16; j++ {
+			if j == 8 {
+				hex.WriteByte(' ')
+			}
+			if j < len(line) {
+				fmt.Fprintf(&hex, " %02x", line[j])
+				if line[j] >= 0x20 && line[j] < 0x7f {
+					ascii.WriteByte(line[j])
+				} else {
+					ascii.WriteByte('.')
+				}
+			} else {
+				hex.WriteString("   ")
+			}
+		}
+		w.write(color(p.theme.AttrValue, hex.String()), "  |", color(p.theme.String, ascii.String()), "|")
+		w.writeln()
+	}
+	if more := size - len(show); more > 0 {
+		w.writeln(color(p.theme.AttrName, fmt.Sprintf("… %d more bytes", more)))
+	}
+}
+
+// truncateString returns at most max bytes of s, without splitting a UTF-8
+// sequence. If max is zero, s is returned in full.
+func truncateString(s string, max int) string {
+	if max <= 0 || len(s) <= max {
+		return s
+	}
+	n := max
+	for n > 0 && n > max-utf8.UTFMax && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	if !utf8.RuneStart(s[n]) {
+		n = max
+	}
+	return s[:n]
+}
+
 var spaceOnly = regexp.MustCompile(`^[ \t]+$`)
 
 func (w *writer) writeIndented(block string) {
@@ -300,27 +758,27 @@ func (w *writer) writeIndented(block string) {
 	}
 }
 
-const (
-	black        = 30
-	red          = 31
-	green        = 32
-	yellow       = 33
-	blue         = 34
-	magenta      = 35
-	cyan         = 36
-	lightGray    = 37
-	darkGray     = 90
-	lightRed     = 91
-	lightGreen   = 92
-	lightYellow  = 93
-	lightBlue    = 94
-	lightMagenta = 95
-	lightCyan    = 96
-	white        = 97
-)
+// color wraps v in the SGR escape sequence sgr, such as "36" or "1;4". If
+// sgr is empty, v is returned without color.
+func color(sgr string, v interface{}) string {
+	if sgr == "" {
+		return fmt.Sprint(v)
+	}
+	return fmt.Sprintf("\x1b[%sm%v\x1b[0m", sgr, v)
+}
 
-func color(col int, v interface{}) string {
-	return fmt.Sprintf("\x1b[%dm%v\x1b[0m", col, v)
+func colorStart(sgr string) string {
+	if sgr == "" {
+		return ""
+	}
+	return "\x1b[" + sgr + "m"
+}
+
+func colorEnd(sgr string) string {
+	if sgr == "" {
+		return ""
+	}
+	return "\x1b[0m"
 }
 
 type colorOut struct {
@@ -356,10 +814,10 @@ func (c colorOut) Format(f fmt.State, r rune) {
 	}
 }
 
-func (c colorOut) Append(col int, v interface{}) colorOut {
+func (c colorOut) Append(sgr string, v interface{}) colorOut {
 	s := fmt.Sprintf("%v", v)
-	c.out += color(col, s)
-	c.len += len(s)
+	c.out += color(sgr, s)
+	c.len += utf8.RuneCountInString(s)
 	return c
 }
 
@@ -367,29 +825,29 @@ func (c colorOut) String() string {
 	return c.out
 }
 
-func colorw(col int, v interface{}) colorOut {
+func colorw(sgr string, v interface{}) colorOut {
 	s := fmt.Sprintf("%v", v)
-	out := color(col, s)
+	out := color(sgr, s)
 	return colorOut{
 		out: out,
-		len: len(s),
+		len: utf8.RuneCountInString(s),
 	}
 }
 
-func colorPadLeft(col int, v interface{}, w int, b byte) string {
+func colorPadLeft(sgr string, v interface{}, w int, b byte) string {
 	s := fmt.Sprintf("%v", v)
 	diff := w - len(s)
 	if diff > 0 {
 		s = strings.Repeat(string(b), diff) + s
 	}
-	return color(col, s)
+	return color(sgr, s)
 }
 
-func colorPadRight(col int, v interface{}, w int, b byte) string {
+func colorPadRight(sgr string, v interface{}, w int, b byte) string {
 	s := fmt.Sprintf("%v", v)
-	diff := w - len(s)
+	diff := w - utf8.RuneCountInString(s)
 	if diff > 0 {
 		s = s + strings.Repeat(string(b), diff)
 	}
-	return color(col, s)
+	return color(sgr, s)
 }
@@ -0,0 +1,183 @@
+package msgplens
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPrinterColor(t *testing.T) {
+	mono := ThemeMono
+	for _, tc := range []struct {
+		opts   PrinterOptions
+		escape string
+	}{
+		{PrinterOptions{}, ""},
+		{PrinterOptions{Color: ColorNever}, ""},
+		{PrinterOptions{Color: ColorAlways}, "\x1b[94m\"foo\""},
+		{PrinterOptions{Color: ColorAlways, Theme: &mono}, "\x1b[4m\"foo\""},
+	} {
+		var out bytes.Buffer
+		if err := WalkBytes(NewPrinterWithOptions(&out, tc.opts), testObject); err != nil {
+			t.Fatal(err)
+		}
+		if tc.escape == "" {
+			if strings.Contains(out.String(), "\x1b") {
+				t.Fatalf("unexpected color:\n%q", out.String())
+			}
+		} else if !strings.Contains(out.String(), tc.escape) {
+			t.Fatalf("%q not found:\n%q", tc.escape, out.String())
+		}
+	}
+
+	// NewPrinter colors output even when it isn't written to a terminal:
+	var out bytes.Buffer
+	if err := WalkBytes(NewPrinter(&out), testObject); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "\x1b[94m\"foo\"") {
+		t.Fatalf("expected color:\n%q", out.String())
+	}
+}
+
+func TestParseTheme(t *testing.T) {
+	theme, err := ParseTheme("int=1;31, String=38;5;117,error=", ThemeDark)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if theme.Int != "1;31" || theme.String != "38;5;117" || theme.Error != "" || theme.Float != ThemeDark.Float {
+		t.Fatalf("unexpected theme %+v", theme)
+	}
+
+	for _, in := range []string{"int", "nope=1", "int=\x1b[1m"} {
+		if _, err := ParseTheme(in, ThemeDark); err == nil {
+			t.Fatalf("expected error for %q", in)
+		}
+	}
+}
+
+func TestPrinterLimits(t *testing.T) {
+	// [0, 1, ..., 9, "héllo world", [[1], {"a": 1}], bin8(300)]
+	in := []byte{0xdc, 0, 13}
+	for i := 0; i < 10; i++ {
+		in = append(in, byte(i))
+	}
+	in = append(in, 0xac)
+	in = append(in, "héllo world"...)
+	in = append(in, 0x92, 0x91, 0x01, 0x81, 0xa1, 'a', 0x01)
+	in = append(in, Bin16, 0x01, 0x2c)
+	in = append(in, bytes.Repeat([]byte{'z'}, 300)...)
+
+	var out bytes.Buffer
+	p := NewPrinterWithOptions(&out, PrinterOptions{MaxBytes: 2, MaxElements: 6, MaxDepth: 2})
+	if err := WalkBytes(p, in); err != nil {
+		t.Fatal(err)
+	}
+	result := out.String()
+	for _, s := range []string{
+		"  2   at:5", "…   7 more elements", " 12  at:",
+		`"h" … 11 more bytes`,
+		"len:1 […]", "len:1 {…}", "sz:2   0x91", "sz:4   0x81",
+		"7a 7a", "… 298 more bytes",
+	} {
+		if !strings.Contains(result, s) {
+			t.Fatalf("%q not found:\n%s", s, result)
+		}
+	}
+	if strings.Contains(result, "  3   at:") {
+		t.Fatalf("element 3 not skipped:\n%s", result)
+	}
+
+	out.Reset()
+	p = NewPrinterWithOptions(&out, PrinterOptions{MaxBytes: 2, MaxElements: 6, MaxDepth: 2})
+	if err := WalkReader(p, bytes.NewReader(in)); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != result {
+		t.Fatalf("output differs:\n%s\n%s", out.String(), result)
+	}
+}
+
+func TestPrinterCompact(t *testing.T) {
+	// {"name": "bob", 1: [true], [1]: "x"}
+	in := []byte{0x83, 0xa4, 'n', 'a', 'm', 'e', 0xa3, 'b', 'o', 'b', 0x01, 0x91, 0xc3, 0x91, 0x01, 0xa1, 'x'}
+	var out bytes.Buffer
+	if err := WalkBytes(NewPrinterWithOptions(&out, PrinterOptions{Compact: true}), in); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(out.String(), "\n")
+	for i, s := range []string{
+		`  "name" (Fixstr@1) => "bob" (Fixstr@6)`,
+		`  1 (Fixint@10) => at:11  sz:1   0x91 (145) Fixarray len:1 [`,
+		`    0   at:12  sz:1   0xc3 (195) True`,
+		`  ]`,
+		`  K2  at:13  sz:1   0x91 (145) Fixarray len:1 [`,
+		`    0   at:14  sz:1   0x01 (001) Fixint   1`,
+		`  ]`,
+		`  V2  at:15  sz:2   0xa1 (161) Fixstr   "x"`,
+	} {
+		if strings.TrimRight(lines[i+1], " ") != s {
+			t.Fatalf("line %d: %q != %q", i+1, lines[i+1], s)
+		}
+	}
+}
+
+func TestPrinterOffsetsAndPath(t *testing.T) {
+	var out bytes.Buffer
+	opts := PrinterOptions{HexOffsets: true, RelativeOffsets: true, ShowEnd: true, ShowPath: true}
+	if err := WalkBytes(NewPrinterWithOptions(&out, opts), testObject); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(out.String(), "\n")
+	for _, s := range []string{
+		"/a/2                         2   at:0x3 sz:4   end:0x7 0xa3 (163) Fixstr   \"foo\"",
+		"/b                         V1  at:0xe sz:9   end:0x17 0xcb (203) Float64  1.5",
+		"/(key 1)                   K1  at:0xc sz:2   end:0xe 0xa1 (161) Fixstr   \"b\"",
+	} {
+		found := false
+		for _, ln := range lines {
+			if ln == s {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("%q not found:\n%s", s, out.String())
+		}
+	}
+}
+
+func TestPrinterContainerSize(t *testing.T) {
+	// {"a": [[1]]}, with a Map16 and an Array32 header:
+	in := []byte{Map16, 0x00, 0x01, 0xa1, 'a', Array32, 0, 0, 0, 1, 0x91, 0x01}
+	var out bytes.Buffer
+	if err := WalkBytes(NewPrinterWithOptions(&out, PrinterOptions{}), in); err != nil {
+		t.Fatal(err)
+	}
+	exp := "" +
+		"at:0   sz:3   0xde (222) Map16    len:1 {\n" +
+		"  K0  at:3   sz:2   0xa1 (161) Fixstr   \"a\"\n" +
+		"  V0  at:5   sz:5   0xdd (221) Array32  len:1 [\n" +
+		"    0   at:10  sz:1   0x91 (145) Fixarray len:1 [\n" +
+		"      0   at:11  sz:1   0x01 (001) Fixint   1\n" +
+		"    ]\n" +
+		"  ]\n" +
+		"}\n"
+	if out.String() != exp {
+		t.Fatalf("\n%s\n!=\n%s", out.String(), exp)
+	}
+}
+
+func TestPrinterExtPreview(t *testing.T) {
+	in := []byte{Ext8, 20, 7, 'h', 'e', 'l', 'l', 'o', 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14}
+	var out bytes.Buffer
+	if err := WalkBytes(NewPrinterWithOptions(&out, PrinterOptions{Color: ColorNever}), in); err != nil {
+		t.Fatal(err)
+	}
+	exp := "" +
+		"at:0   sz:23  0xc7 (199) Ext8     type:7 len:20\n" +
+		"  0000  68 65 6c 6c 6f 00 01 02  03 04 05 06 07 08 09 0a  |hello...........|\n" +
+		"  0010  0b 0c 0d 0e                                       |....|\n"
+	if out.String() != exp {
+		t.Fatalf("%q\n!=\n%q", out.String(), exp)
+	}
+}
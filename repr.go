@@ -14,6 +14,21 @@ type Node interface {
 	Msgpack(into *bytes.Buffer) error
 	TotalSize() int
 
+	// See node.go for the accessors.
+	Type() Type
+	Len() int
+	Index(i int) (Node, bool)
+	Get(key interface{}) (Node, bool)
+	AsString() (string, bool)
+	AsBytes() ([]byte, bool)
+	AsInt() (int64, bool)
+	AsUint() (uint64, bool)
+	AsFloat() (float64, bool)
+	AsBool() (bool, bool)
+	AsExtension() (Extension, bool)
+	Clone() Node
+
+	common() *commonNode
 	setCommon(prefix uint8, size int)
 }
 
@@ -41,10 +56,16 @@ func (n *FloatNode) Msgpack(into *bytes.Buffer) error {
 	typ := sizes[n.Prefix].typ
 	switch typ {
 	case Float64Type:
+		if len(n.Bits) != 8 {
+			return fmt.Errorf("float64 expected 8 bits bytes, found %d", len(n.Bits))
+		}
 		into.WriteByte(n.Prefix)
 		into.Write(n.Bits)
 
 	case Float32Type:
+		if len(n.Bits) != 4 {
+			return fmt.Errorf("float32 expected 4 bits bytes, found %d", len(n.Bits))
+		}
 		into.WriteByte(n.Prefix)
 		into.Write(n.Bits)
 
@@ -67,6 +88,9 @@ func (n *IntNode) Msgpack(into *bytes.Buffer) error {
 		if isfixint(n.Prefix) || isnfixint(n.Prefix) {
 			into.WriteByte(n.Prefix)
 		} else {
+			if len(n.Bits) != 8 {
+				return fmt.Errorf("int expected 8 bits bytes, found %d", len(n.Bits))
+			}
 			u := byteOrder.Uint64(n.Bits)
 			i := int64(u)
 			var b []byte
@@ -111,6 +135,9 @@ func (n *UintNode) Msgpack(into *bytes.Buffer) error {
 		if isfixint(n.Prefix) {
 			into.WriteByte(n.Prefix)
 		} else {
+			if len(n.Bits) != 8 {
+				return fmt.Errorf("uint expected 8 bits bytes, found %d", len(n.Bits))
+			}
 			u := byteOrder.Uint64(n.Bits)
 			var b []byte
 			switch n.Prefix {
@@ -164,6 +191,39 @@ func (n *NilNode) Msgpack(into *bytes.Buffer) error {
 type ExtensionNode struct {
 	commonNode
 	Contents []byte
+
+	// Value and Document are set if the extension was decoded by an
+	// ExtRegistry. Value is the decoder's JSON value, and Document holds the
+	// nodes of any msgpack document contained in the extension. Like the
+	// Approx fields of the number nodes, they are informational only;
+	// Contents is used to encode the node.
+	Value    interface{} `json:",omitempty"`
+	Document NodeList    `json:",omitempty"`
+}
+
+func newExtensionNode(ctx *LensContext, bts []byte, reg *ExtRegistry) (*ExtensionNode, error) {
+	n := &ExtensionNode{
+		commonNode: commonNode{Prefix: bts[0], Size: len(bts)},
+		Contents:   bts}
+
+	v, ok := reg.decodeExt(bts)
+	if !ok {
+		return n, nil
+	}
+	n.Value = v.JSON
+	if v.Msgpack != nil {
+		sub := NewRepresenter()
+		sub.Extensions = reg
+		walk := DefaultWalkOptions.WalkBytes
+		if ctx != nil {
+			walk = ctx.walkNested
+		}
+		if err := walk(sub, v.Msgpack); err != nil {
+			return nil, err
+		}
+		n.Document = sub.Nodes()
+	}
+	return n, nil
 }
 
 func (e *ExtensionNode) Msgpack(into *bytes.Buffer) error {
@@ -380,31 +440,52 @@ func ReprUnmarshalNode(in []byte) (Node, error) {
 }
 
 type Representer struct {
-	vis   *Visitor
-	root  NodeList
-	nodes *NodeList
-	stack []*NodeList
+	vis     *Visitor
+	root    NodeList
+	offsets []int
+	nodes   *NodeList
+	stack   []*NodeList
+
+	// Extensions decodes extension objects. If nil, DefaultExtRegistry is
+	// used.
+	Extensions *ExtRegistry
 }
 
 func (r *Representer) Visitor() *Visitor {
 	return r.vis
 }
 
+// Nodes returns the top level nodes that were walked, in order. If bytes
+// remained after a single object was walked, they are included as a trailing
+// BinNode.
 func (r *Representer) Nodes() []Node {
 	return r.root
 }
 
+// Offsets returns the offset of each top level object when every object in a
+// stream was walked, in the same order as Nodes. It is nil otherwise.
+func (r *Representer) Offsets() []int {
+	return r.offsets
+}
+
 func NewRepresenter() *Representer {
 	r := &Representer{}
 	r.nodes = &r.root
 
 	r.vis = &Visitor{
+		EnterRoot: func(ctx *LensContext, n int) error {
+			if ctx.multi {
+				r.offsets = append(r.offsets, ctx.RootPos())
+			}
+			return nil
+		},
+
 		Int: func(ctx *LensContext, bts []byte, data int64) error {
 			bits := make([]byte, 8)
 			byteOrder.PutUint64(bits, uint64(data))
 			*r.nodes = append(*r.nodes, &IntNode{
 				commonNode: commonNode{Prefix: bts[0], Size: len(bts)},
-				Bits:       bts,
+				Bits:       bits,
 				Approx:     data})
 			return nil
 		},
@@ -414,7 +495,7 @@ func NewRepresenter() *Representer {
 			byteOrder.PutUint64(bits, data)
 			*r.nodes = append(*r.nodes, &UintNode{
 				commonNode: commonNode{Prefix: bts[0], Size: len(bts)},
-				Bits:       bts,
+				Bits:       bits,
 				Approx:     data})
 			return nil
 		},
@@ -424,7 +505,7 @@ func NewRepresenter() *Representer {
 			byteOrder.PutUint64(bits, math.Float64bits(data))
 			*r.nodes = append(*r.nodes, &FloatNode{
 				commonNode: commonNode{Prefix: bts[0], Size: len(bts)},
-				Bits:       bts,
+				Bits:       bits,
 				Approx:     data})
 			return nil
 		},
@@ -434,7 +515,7 @@ func NewRepresenter() *Representer {
 			byteOrder.PutUint32(bits, math.Float32bits(data))
 			*r.nodes = append(*r.nodes, &FloatNode{
 				commonNode: commonNode{Prefix: bts[0], Size: len(bts)},
-				Bits:       bts,
+				Bits:       bits,
 				Approx:     float64(data)})
 			return nil
 		},
@@ -467,9 +548,11 @@ func NewRepresenter() *Representer {
 		},
 
 		Extension: func(ctx *LensContext, bts []byte) error {
-			*r.nodes = append(*r.nodes, &ExtensionNode{
-				commonNode: commonNode{Prefix: bts[0], Size: len(bts)},
-				Contents:   bts})
+			node, err := newExtensionNode(ctx, bts, r.Extensions)
+			if err != nil {
+				return err
+			}
+			*r.nodes = append(*r.nodes, node)
 			return nil
 		},
 
@@ -512,6 +595,9 @@ func NewRepresenter() *Representer {
 		},
 
 		End: func(ctx *LensContext, left []byte) error {
+			if len(left) == 0 {
+				return nil
+			}
 			*r.nodes = append(*r.nodes, &BinNode{
 				commonNode: commonNode{Prefix: Bin32, Size: len(left)},
 				Value:      left})
@@ -0,0 +1,441 @@
+package msgplens
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+)
+
+// ReprVersion is the version of the repr documents written by ReprMarshal.
+//
+// Version 1 is a Node marshalled with encoding/json, one per document: the
+// Prefix is a number, Bits and Bin values are base64, and an extension's
+// Contents hold its whole encoding, header included.
+//
+// Version 2 wraps any number of nodes in a {"version":2,"roots":[...]}
+// envelope. Each node has a Name, such as "Uint16", alongside its Prefix;
+// Bits and Bin values are hex; and extensions have a Type and Data instead
+// of Contents. Top level nodes walked from a stream of objects are numbered
+// with a Root, and give their offset in the stream as Pos.
+const ReprVersion = 2
+
+type reprDocument struct {
+	Version int           `json:"version"`
+	Roots   []*reprV2Node `json:"roots"`
+}
+
+// reprV2Node is the version 2 repr of any Node. When reading, Prefix may be
+// left out in favour of Name. Fix names, such as "Fixstr", stand for the
+// whole range of prefixes, of which the right one is worked out from the
+// node's length or value. A node whose value or length doesn't fit its
+// prefix is an error. If Size is left out, it is the size of the prefix's
+// header.
+type reprV2Node struct {
+	// Root and Pos number a top level node and give its offset in the
+	// msgpack it was read from, if known. They are ignored when reading.
+	Root *int `json:",omitempty"`
+	Pos  *int `json:",omitempty"`
+
+	Prefix *int   `json:",omitempty"`
+	Name   string `json:",omitempty"`
+	Size   *int   `json:",omitempty"`
+
+	// Bits holds the big endian bits of ints, uints and floats, as hex.
+	// Approx is their approximate value, for reading only.
+	Bits   string          `json:",omitempty"`
+	Approx json.RawMessage `json:",omitempty"`
+
+	// Value is a Bool's value, a Str's value, a Bin's value as hex, or the
+	// value decoded from an extension by an ExtRegistry.
+	Value json.RawMessage `json:",omitempty"`
+
+	Type     *int8         `json:",omitempty"`
+	Data     *string       `json:",omitempty"`
+	Document []*reprV2Node `json:",omitempty"`
+
+	Children []*reprV2Node `json:",omitempty"`
+	Values   []reprV2Entry `json:",omitempty"`
+}
+
+type reprV2Entry struct {
+	Key   *reprV2Node
+	Value *reprV2Node
+}
+
+// ReprMarshal writes nodes as a repr document of the current ReprVersion.
+func ReprMarshal(nodes []Node) ([]byte, error) {
+	return ReprMarshalOffsets(nodes, nil)
+}
+
+// ReprMarshalOffsets is ReprMarshal, but also numbers each node and records
+// its offset, offsets[i], such as those from Representer.Offsets. Nodes
+// beyond the end of offsets are written as they are by ReprMarshal.
+func ReprMarshalOffsets(nodes []Node, offsets []int) ([]byte, error) {
+	doc := reprDocument{Version: ReprVersion, Roots: make([]*reprV2Node, len(nodes))}
+	for i, n := range nodes {
+		var err error
+		if doc.Roots[i], err = reprV2FromNode(n); err != nil {
+			return nil, err
+		}
+		if i < len(offsets) {
+			root, pos := i, offsets[i]
+			doc.Roots[i].Root, doc.Roots[i].Pos = &root, &pos
+		}
+	}
+	return json.Marshal(doc)
+}
+
+// ReprUnmarshal reads a stream of repr documents of any version, and returns
+// the nodes they hold in order.
+func ReprUnmarshal(in []byte) ([]Node, error) {
+	var nodes []Node
+	decoder := json.NewDecoder(bytes.NewReader(in))
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err == io.EOF {
+			return nodes, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		var head struct{ Version *int }
+		if err := json.Unmarshal(raw, &head); err != nil {
+			return nil, err
+		}
+		if head.Version == nil {
+			node, err := ReprUnmarshalNode(raw)
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, node)
+			continue
+		}
+		if *head.Version != 2 {
+			return nil, fmt.Errorf("unsupported repr version %d", *head.Version)
+		}
+
+		var doc reprDocument
+		if err := json.Unmarshal(raw, &doc); err != nil {
+			return nil, err
+		}
+		for i, r := range doc.Roots {
+			if r == nil {
+				return nil, fmt.Errorf("root %d is null", i)
+			}
+			node, err := r.node()
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, node)
+		}
+	}
+}
+
+func reprV2FromNode(node Node) (*reprV2Node, error) {
+	r := &reprV2Node{}
+	var err error
+
+	switch n := node.(type) {
+	case *NilNode:
+
+	case *BoolNode:
+		r.Value, err = json.Marshal(n.Value)
+
+	case *IntNode:
+		r.Bits = hex.EncodeToString(n.Bits)
+		r.Approx, err = json.Marshal(n.Approx)
+
+	case *UintNode:
+		r.Bits = hex.EncodeToString(n.Bits)
+		r.Approx, err = json.Marshal(n.Approx)
+
+	case *FloatNode:
+		r.Bits = hex.EncodeToString(n.Bits)
+		if !math.IsNaN(n.Approx) && !math.IsInf(n.Approx, 0) {
+			r.Approx, err = json.Marshal(n.Approx)
+		}
+
+	case *StrNode:
+		r.Value, err = json.Marshal(n.Value)
+
+	case *BinNode:
+		r.Value, err = json.Marshal(hex.EncodeToString(n.Value))
+
+	case *ExtensionNode:
+		ext := readExtension(n.Contents)
+		data := hex.EncodeToString(ext.Data)
+		r.Type, r.Data = &ext.Type, &data
+		if n.Value != nil {
+			r.Value, err = json.Marshal(n.Value)
+		}
+		for _, d := range n.Document {
+			rd, err := reprV2FromNode(d)
+			if err != nil {
+				return nil, err
+			}
+			r.Document = append(r.Document, rd)
+		}
+
+	case *ArrayNode:
+		r.Children = make([]*reprV2Node, len(n.Children))
+		for i, c := range n.Children {
+			if r.Children[i], err = reprV2FromNode(c); err != nil {
+				return nil, err
+			}
+		}
+
+	case *MapNode:
+		r.Values = make([]reprV2Entry, len(n.Values))
+		for i, kv := range n.Values {
+			if r.Values[i].Key, err = reprV2FromNode(kv.Key); err != nil {
+				return nil, err
+			}
+			if r.Values[i].Value, err = reprV2FromNode(kv.Value); err != nil {
+				return nil, err
+			}
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported node type %T", node)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := node.common()
+	p, size := int(c.Prefix), c.Size
+	r.Prefix, r.Name, r.Size = &p, prefixName(c.Prefix), &size
+	return r, nil
+}
+
+func (r *reprV2Node) node() (Node, error) {
+	prefix, err := r.prefix()
+	if err != nil {
+		return nil, err
+	}
+	if r.Name == "" {
+		r.Name = prefixName(prefix)
+	}
+	node, err := r.build(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if prefix, err = r.fit(prefix, node); err != nil {
+		return nil, err
+	}
+	size := headerSize(prefix)
+	if r.Size != nil {
+		size = *r.Size
+	}
+	node.setCommon(prefix, size)
+	return node, nil
+}
+
+// build returns the node, with prefix as its Prefix for now.
+func (r *reprV2Node) build(prefix byte) (Node, error) {
+	var err error
+	common := commonNode{Prefix: prefix}
+
+	switch typ := sizes[prefix].typ; typ {
+	case NilType:
+		return &NilNode{commonNode: common}, nil
+
+	case BoolType:
+		n := &BoolNode{commonNode: common}
+		return n, r.value(&n.Value)
+
+	case IntType, UintType, Float32Type, Float64Type:
+		bits, err := hex.DecodeString(r.Bits)
+		if err != nil {
+			return nil, err
+		}
+		want := 8
+		if typ == Float32Type {
+			want = 4
+		}
+		if len(bits) != want {
+			return nil, fmt.Errorf("%s expected %d bits bytes, found %d", prefixName(prefix), want, len(bits))
+		}
+
+		switch typ {
+		case IntType:
+			return &IntNode{commonNode: common, Bits: bits, Approx: int64(byteOrder.Uint64(bits))}, nil
+		case UintType:
+			return &UintNode{commonNode: common, Bits: bits, Approx: byteOrder.Uint64(bits)}, nil
+		case Float32Type:
+			return &FloatNode{commonNode: common, Bits: bits, Approx: float64(math.Float32frombits(byteOrder.Uint32(bits)))}, nil
+		default:
+			return &FloatNode{commonNode: common, Bits: bits, Approx: math.Float64frombits(byteOrder.Uint64(bits))}, nil
+		}
+
+	case StrType:
+		n := &StrNode{commonNode: common}
+		return n, r.value(&n.Value)
+
+	case BinType:
+		var s string
+		if err := r.value(&s); err != nil {
+			return nil, err
+		}
+		v, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return &BinNode{commonNode: common, Value: v}, nil
+
+	case ExtensionType:
+		if r.Type == nil || r.Data == nil {
+			return nil, fmt.Errorf("extension requires Type and Data")
+		}
+		data, err := hex.DecodeString(*r.Data)
+		if err != nil {
+			return nil, err
+		}
+		if sizes[prefix].extra == constsize && len(data) != int(sizes[prefix].size)-2 {
+			return nil, fmt.Errorf("%s expected %d data bytes, found %d", prefixName(prefix), sizes[prefix].size-2, len(data))
+		}
+		n := &ExtensionNode{commonNode: common, Contents: writeExtension(prefix, *r.Type, data)}
+		if len(r.Value) > 0 {
+			if err := json.Unmarshal(r.Value, &n.Value); err != nil {
+				return nil, err
+			}
+		}
+		for i, d := range r.Document {
+			if d == nil {
+				return nil, fmt.Errorf("document node %d is null", i)
+			}
+			dn, err := d.node()
+			if err != nil {
+				return nil, err
+			}
+			n.Document = append(n.Document, dn)
+		}
+		return n, nil
+
+	case ArrayType:
+		n := &ArrayNode{commonNode: common, Children: make(NodeList, len(r.Children))}
+		for i, c := range r.Children {
+			if c == nil {
+				return nil, fmt.Errorf("child %d is null", i)
+			}
+			if n.Children[i], err = c.node(); err != nil {
+				return nil, err
+			}
+		}
+		return n, nil
+
+	case MapType:
+		n := &MapNode{commonNode: common, Values: make([]KeyValueNode, len(r.Values))}
+		for i, kv := range r.Values {
+			if kv.Key == nil || kv.Value == nil {
+				return nil, fmt.Errorf("map entry %d requires Key and Value", i)
+			}
+			if n.Values[i].Key, err = kv.Key.node(); err != nil {
+				return nil, err
+			}
+			if n.Values[i].Value, err = kv.Value.node(); err != nil {
+				return nil, err
+			}
+		}
+		return n, nil
+
+	default:
+		return nil, fmt.Errorf("unknown type %s", typ)
+	}
+}
+
+// fit checks that the node's value or length fits in prefix, and returns the
+// prefix it should have. Fix prefixes carry the value or length themselves,
+// so if the prefix was found by its Name, the right one is worked out.
+func (r *reprV2Node) fit(prefix byte, node Node) (byte, error) {
+	want := prefix
+	switch typ := sizes[prefix].typ; {
+	case isfixint(prefix) || isnfixint(prefix):
+		v := node.(*IntNode).Approx
+		if v >= 0 && v <= 0x7f {
+			want = wfixint(byte(v))
+		} else if v >= -32 && v < 0 {
+			want = wnfixint(int8(v))
+		}
+		if v < -32 || v > 0x7f || prefixName(want) != r.Name {
+			return 0, fmt.Errorf("%s can't hold %d", r.Name, v)
+		}
+
+	case typ == BoolType:
+		if v := node.(*BoolNode).Value; v != (prefix == True) {
+			return 0, fmt.Errorf("%s can't hold %v", r.Name, v)
+		}
+
+	case typ == IntType:
+		v, shift := node.(*IntNode).Approx, 64-8*(sizes[prefix].size-1)
+		if v<<shift>>shift != v {
+			return 0, fmt.Errorf("%s can't hold %d", r.Name, v)
+		}
+
+	case typ == UintType:
+		v, bits := node.(*UintNode).Approx, 8*(sizes[prefix].size-1)
+		if v>>bits != 0 {
+			return 0, fmt.Errorf("%s can't hold %d", r.Name, v)
+		}
+
+	case isfixstr(prefix) || (typ == ArrayType && isfixarray(prefix)) || (typ == MapType && isfixmap(prefix)):
+		n, max := node.Len(), 0x1f
+		if typ != StrType {
+			max = 0x0f
+		}
+		if n > max {
+			return 0, fmt.Errorf("%s can't hold length %d", r.Name, n)
+		}
+		switch typ {
+		case StrType:
+			want = wfixstr(uint8(n))
+		case ArrayType:
+			want = wfixarray(uint8(n))
+		default:
+			want = wfixmap(uint8(n))
+		}
+
+	case typ == StrType || typ == BinType || typ == ExtensionType || typ == ArrayType || typ == MapType:
+		if n := node.Len(); !taggedFits(prefix, n) {
+			return 0, fmt.Errorf("%s can't hold length %d", r.Name, n)
+		}
+	}
+
+	if r.Prefix != nil && want != prefix {
+		return 0, fmt.Errorf("%s prefix 0x%02x doesn't match its contents, expected 0x%02x", r.Name, prefix, want)
+	}
+	return want, nil
+}
+
+// prefix returns the node's Prefix, or the first prefix with its Name.
+func (r *reprV2Node) prefix() (byte, error) {
+	if r.Prefix != nil {
+		if *r.Prefix < 0 || *r.Prefix > 255 {
+			return 0, fmt.Errorf("invalid prefix %d", *r.Prefix)
+		}
+		prefix := byte(*r.Prefix)
+		if r.Name != "" && r.Name != prefixName(prefix) {
+			return 0, fmt.Errorf("prefix %02x is %s, not %s", prefix, prefixName(prefix), r.Name)
+		}
+		return prefix, nil
+	}
+	if r.Name == "" {
+		return 0, fmt.Errorf("node requires Prefix or Name")
+	}
+	for i := 0; i < len(sizes); i++ {
+		if sizes[i].name == r.Name {
+			return byte(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown prefix name %q", r.Name)
+}
+
+func (r *reprV2Node) value(into interface{}) error {
+	if len(r.Value) == 0 {
+		return fmt.Errorf("%s requires Value", r.Name)
+	}
+	return json.Unmarshal(r.Value, into)
+}
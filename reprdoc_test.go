@@ -0,0 +1,135 @@
+package msgplens
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestReprRoundTrip(t *testing.T) {
+	// [-1, 200 as Uint16, 1.5, "a", bin(0x01), ext(5, "y"), {1: [nil, true]}], NaN
+	in := []byte{
+		0x97, 0xff, Uint16, 0x00, 0xc8, Float64, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0, 0xa1, 'a',
+		Bin8, 0x01, 0x01, Fixext1, 0x05, 'y', 0x81, 0x01, 0x92, Nil, True,
+		Float32, 0x7f, 0xc0, 0x00, 0x01,
+	}
+
+	repr := NewRepresenter()
+	if err := WalkAllBytes(repr, in); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := ReprMarshal(repr.Nodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		`{"version":2,"roots":[`,
+		`"Prefix":205,"Name":"Uint16","Size":3,"Bits":"00000000000000c8","Approx":200`,
+		`"Name":"Bin8","Size":3,"Value":"01"`,
+		`"Name":"Fixext1","Size":3,"Type":5,"Data":"79"`,
+		`"Name":"Float32","Size":5,"Bits":"7fc00001"}`,
+	} {
+		if !strings.Contains(string(doc), s) {
+			t.Fatalf("%s not found in:\n%s", s, doc)
+		}
+	}
+
+	// Version 1 documents, one per node, can follow a version 2 document:
+	v1, err := json.Marshal(repr.Nodes()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := ReprUnmarshal(append(append(doc, '\n'), v1...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 3 {
+		t.Fatalf("expected 3 nodes, found %d", len(nodes))
+	}
+
+	var out bytes.Buffer
+	for _, n := range nodes {
+		if err := n.Msgpack(&out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exp := append(append([]byte{}, in...), in[:len(in)-5]...)
+	if !bytes.Equal(out.Bytes(), exp) {
+		t.Fatalf("% x\n!=\n% x", out.Bytes(), exp)
+	}
+}
+
+func TestReprUnmarshalNames(t *testing.T) {
+	nodes, err := ReprUnmarshal([]byte(`{"version":2,"roots":[
+		{"Name":"Fixarray","Children":[
+			{"Name":"FixintNeg","Bits":"fffffffffffffffe"},
+			{"Name":"Fixstr","Value":"ab"},
+			{"Name":"Ext8","Type":1,"Data":"ff"}
+		]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := nodes[0].Msgpack(&out); err != nil {
+		t.Fatal(err)
+	}
+	exp := []byte{0x93, 0xfe, 0xa2, 'a', 'b', Ext8, 0x01, 0x01, 0xff}
+	if !bytes.Equal(out.Bytes(), exp) {
+		t.Fatalf("% x != % x", out.Bytes(), exp)
+	}
+
+	for _, in := range []string{
+		`{"version":3,"roots":[]}`,
+		`{"version":2,"roots":[{"Prefix":205,"Name":"Uint8","Bits":"00000000000000c8"}]}`,
+		`{"version":2,"roots":[{"Name":"Fixext1","Type":1,"Data":"ffff"}]}`,
+	} {
+		if _, err := ReprUnmarshal([]byte(in)); err == nil {
+			t.Fatalf("expected error for %s", in)
+		}
+	}
+}
+
+func TestReprUnmarshalFit(t *testing.T) {
+	nodes, err := ReprUnmarshal([]byte(`{"version":2,"roots":[
+		{"Name":"Fixmap","Values":[]},
+		{"Name":"Str8","Value":"abc"},
+		{"Name":"Int8","Bits":"ffffffffffffff80"},
+		{"Name":"Uint32","Bits":"00000000ffffffff"},
+		{"Prefix":161,"Value":"a"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, exp := range []struct {
+		prefix byte
+		size   int
+	}{{0x80, 1}, {Str8, 2}, {Int8, 2}, {Uint32, 5}, {0xa1, 1}} {
+		if c := nodes[i].common(); c.Prefix != exp.prefix || c.Size != exp.size {
+			t.Fatalf("node %d: prefix 0x%02x size %d, expected 0x%02x size %d", i, c.Prefix, c.Size, exp.prefix, exp.size)
+		}
+	}
+
+	for _, root := range []string{
+		`{"Name":"Ext8","Type":1,"Data":"` + strings.Repeat("ff", 300) + `"}`,
+		`{"Name":"Fixstr","Value":"` + strings.Repeat("a", 40) + `"}`,
+		`{"Name":"Fixint","Bits":"00000000000000c8"}`,
+		`{"Name":"Fixint","Bits":"ffffffffffffffff"}`,
+		`{"Name":"FixintNeg","Bits":"0000000000000001"}`,
+		`{"Name":"Int8","Bits":"0000000000000080"}`,
+		`{"Name":"Uint16","Bits":"0000000000010000"}`,
+		`{"Name":"Fixarray","Children":[` + strings.TrimSuffix(strings.Repeat(`{"Name":"Nil"},`, 16), ",") + `]}`,
+		`{"Prefix":162,"Value":"a"}`,
+		`{"Name":"True","Value":false}`,
+		`{"Name":"False","Value":true}`,
+		`null`,
+		`{"Name":"Fixarray","Children":[null]}`,
+		`{"Name":"Ext8","Type":1,"Data":"","Document":[null]}`,
+	} {
+		in := `{"version":2,"roots":[` + root + `]}`
+		if _, err := ReprUnmarshal([]byte(in)); err == nil {
+			t.Fatalf("expected error for %.80s", in)
+		}
+	}
+}
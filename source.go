@@ -0,0 +1,288 @@
+package msgplens
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+)
+
+// maxHeaderSize is the largest number of bytes needed to read the prefix and
+// any length fields of a msgpack object (Ext32: prefix, 4 byte length, type).
+const maxHeaderSize = 6
+
+// readerStreamThreshold is the payload size above which WalkReader hands Str
+// and Bin payloads to Visitor.StrStream and Visitor.BinStream rather than
+// buffering them.
+const readerStreamThreshold = 64 * 1024
+
+// source abstracts over the input to a LensContext so the same walker can
+// read from a fully buffered slice or incrementally from an io.Reader.
+type source interface {
+	// pos returns the offset of the next unread byte.
+	pos() int
+
+	// peek returns the next n bytes without consuming them. It may return
+	// fewer than n bytes if the input ends first.
+	peek(n int) ([]byte, error)
+
+	// next consumes the next n bytes and returns them.
+	next(n int) ([]byte, error)
+
+	// remaining returns the number of unread bytes, or -1 if it is not known.
+	remaining() int
+
+	// skip consumes the next n bytes without returning them.
+	skip(n int) error
+
+	// streamable reports whether a payload of n bytes should be offered to
+	// the visitor as a stream rather than a slice.
+	streamable(n int) bool
+
+	// stream returns a reader that consumes the next n bytes.
+	stream(n int) io.Reader
+
+	// since returns the bytes consumed since the offset start, or nil if
+	// they are no longer available.
+	since(start int) []byte
+
+	// rest consumes and returns all of the remaining input.
+	rest() ([]byte, error)
+}
+
+// cursor reads object headers from a source, enforcing the limits in a
+// WalkOptions. It is shared by the LensContext and the Decoder.
+type cursor struct {
+	opts  WalkOptions
+	src   source
+	elems int
+
+	// depth is the number of containers that enclose the input, if it is a
+	// document nested in an extension. It counts towards MaxDepth.
+	depth int
+
+	// last is the offset of the most recent header, and prefix is its first
+	// byte, or -1 if it could not be read.
+	last   int
+	prefix int
+}
+
+// header reads the header of the next object without consuming it, and
+// checks it against the limits in the WalkOptions.
+func (c *cursor) header() (prefix byte, sz, objs uintptr, err error) {
+	c.last = c.src.pos()
+	c.prefix = -1
+
+	hdr, err := c.src.peek(maxHeaderSize)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if len(hdr) == 0 {
+		return 0, 0, 0, &shortReadError{expected: 1, available: 0}
+	}
+
+	prefix = hdr[0]
+	c.prefix = int(prefix)
+	sz, objs, err = getSize(hdr)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	c.elems++
+	if c.opts.MaxElements > 0 && c.elems > c.opts.MaxElements {
+		return 0, 0, 0, &limitError{limit: "elements", max: c.opts.MaxElements, found: c.elems}
+	}
+
+	if objs > 0 {
+		cnt := int(objs)
+		if getType(prefix) == MapType {
+			cnt /= 2
+		}
+		if c.opts.MaxContainerLen > 0 && cnt > c.opts.MaxContainerLen {
+			return 0, 0, 0, &limitError{limit: "container length", max: c.opts.MaxContainerLen, found: cnt}
+		}
+		// Every object takes at least one byte, so the header can't claim
+		// more children than there are bytes left:
+		if left := c.src.remaining(); c.opts.Strict && left >= 0 && int(sz+objs) > left {
+			return 0, 0, 0, &shortReadError{expected: int(sz + objs), available: left}
+		}
+	}
+
+	return prefix, sz, objs, nil
+}
+
+// skip consumes objs objects from the input, including all of their
+// children, without visiting them.
+func (c *cursor) skip(objs uintptr) error {
+	for objs > 0 {
+		_, sz, children, err := c.header()
+		if err != nil {
+			return err
+		}
+		if err := c.src.skip(int(sz)); err != nil {
+			return err
+		}
+		objs += children - 1
+	}
+	return nil
+}
+
+// checkDepth returns an error if a container can't be entered at the given
+// depth.
+func (c *cursor) checkDepth(depth int) error {
+	depth += c.depth
+	if c.opts.MaxDepth > 0 && depth >= c.opts.MaxDepth {
+		return &limitError{limit: "depth", max: c.opts.MaxDepth, found: depth + 1}
+	}
+	return nil
+}
+
+type bytesSource struct {
+	bts []byte
+	cur int
+}
+
+func (s *bytesSource) pos() int { return s.cur }
+
+func (s *bytesSource) remaining() int { return len(s.bts) - s.cur }
+
+func (s *bytesSource) peek(n int) ([]byte, error) {
+	end := s.cur + n
+	if end > len(s.bts) {
+		end = len(s.bts)
+	}
+	return s.bts[s.cur:end], nil
+}
+
+func (s *bytesSource) next(n int) ([]byte, error) {
+	if n < 0 || n > len(s.bts)-s.cur {
+		return nil, &shortReadError{expected: n, available: len(s.bts) - s.cur}
+	}
+	out := s.bts[s.cur : s.cur+n]
+	s.cur += n
+	return out, nil
+}
+
+func (s *bytesSource) skip(n int) error {
+	_, err := s.next(n)
+	return err
+}
+
+func (s *bytesSource) streamable(n int) bool { return false }
+
+func (s *bytesSource) stream(n int) io.Reader {
+	bts, _ := s.next(n)
+	return bytes.NewReader(bts)
+}
+
+func (s *bytesSource) since(start int) []byte {
+	return s.bts[start:s.cur]
+}
+
+func (s *bytesSource) rest() ([]byte, error) {
+	out := s.bts[s.cur:]
+	s.cur = len(s.bts)
+	return out, nil
+}
+
+type readerSource struct {
+	rdr *bufio.Reader
+	cur int
+}
+
+func newReaderSource(rdr io.Reader) *readerSource {
+	return &readerSource{rdr: bufio.NewReader(rdr)}
+}
+
+func (s *readerSource) pos() int { return s.cur }
+
+func (s *readerSource) remaining() int { return -1 }
+
+func (s *readerSource) peek(n int) ([]byte, error) {
+	bts, err := s.rdr.Peek(n)
+	if err == io.EOF {
+		err = nil
+	}
+	return bts, err
+}
+
+func (s *readerSource) next(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, &shortReadError{expected: n, available: 0}
+	}
+
+	// Slices returned by next are handed to visitors, which may hold on to
+	// them (the Representer does), so they can't alias the bufio buffer.
+	if n <= readerStreamThreshold {
+		out := make([]byte, n)
+		rn, err := io.ReadFull(s.rdr, out)
+		s.cur += rn
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, &shortReadError{expected: n, available: rn}
+		} else if err != nil {
+			return nil, err
+		}
+		return out, nil
+	}
+
+	// Don't trust a large length before the bytes have actually arrived;
+	// grow the buffer as they are read instead.
+	var buf bytes.Buffer
+	rn, err := io.CopyN(&buf, s.rdr, int64(n))
+	s.cur += int(rn)
+	if err == io.EOF {
+		return nil, &shortReadError{expected: n, available: int(rn)}
+	} else if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *readerSource) skip(n int) error {
+	if n < 0 {
+		return &shortReadError{expected: n, available: 0}
+	}
+	dn, err := s.rdr.Discard(n)
+	s.cur += dn
+	if err == io.EOF {
+		return &shortReadError{expected: n, available: dn}
+	}
+	return err
+}
+
+func (s *readerSource) streamable(n int) bool { return n > readerStreamThreshold }
+
+func (s *readerSource) stream(n int) io.Reader {
+	return &streamReader{src: s, left: n}
+}
+
+func (s *readerSource) since(start int) []byte { return nil }
+
+func (s *readerSource) rest() ([]byte, error) {
+	out, err := ioutil.ReadAll(s.rdr)
+	s.cur += len(out)
+	return out, err
+}
+
+// streamReader reads a fixed number of bytes from a readerSource, keeping
+// the source's position up to date.
+type streamReader struct {
+	src  *readerSource
+	left int
+}
+
+func (r *streamReader) Read(b []byte) (n int, err error) {
+	if r.left <= 0 {
+		return 0, io.EOF
+	}
+	if len(b) > r.left {
+		b = b[:r.left]
+	}
+	n, err = r.src.rdr.Read(b)
+	r.left -= n
+	r.src.cur += n
+	if err == io.EOF && r.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
@@ -0,0 +1,691 @@
+package msgplens
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Tagged JSON is a lossless JSON representation of msgpack that stays close
+// to plain JSON. Objects are written as plain JSON wherever UnmarshalJSON
+// would turn that JSON back into the same bytes, and as an object with a
+// single "$" tag key wherever it wouldn't:
+//
+//	{"$u16":200}                     An int wider than it needs to be; a plain 200 is a Uint8
+//	{"$i8":5}                        An Int where a plain 5 would be a positive fixint
+//	{"$f32":1.5}                     A Float32; plain numbers with a fraction are Float64s
+//	{"$f64":"0x7ff8000000000001"}    A float's bits, for NaN and infinity
+//	{"$bin":"01ff"}                  A Bin, as hex
+//	{"$str16":"abc"}                 A Str wider than it needs to be
+//	{"$strhex":"c328"}               A Str that isn't valid UTF-8, as hex
+//	{"$ext":{"type":5,"data":"79"}}  An extension, with its data as hex
+//	{"$array16":[1]}                 An array wider than it needs to be
+//	{"$map":[[1,"a"],[2,"b"]]}       A map that can't be a plain object
+//
+// Bin, Str, extension, array and map tags without a width, like "$bin", use
+// the smallest encoding; "$bin16", "$str8hex", "$ext32", "$map16" and so on
+// give the width explicitly. A map is written as a plain object only if
+// every key is a string that would be written plainly, and its first key
+// doesn't start with "$": any object whose first key starts with "$" is a
+// tag.
+
+// taggedPrefixes maps each tag with an explicit width to its prefix.
+var taggedPrefixes = map[string]byte{
+	"u8": Uint8, "u16": Uint16, "u32": Uint32, "u64": Uint64,
+	"i8": Int8, "i16": Int16, "i32": Int32, "i64": Int64,
+	"f32": Float32, "f64": Float64,
+	"str8": Str8, "str16": Str16, "str32": Str32,
+	"bin8": Bin8, "bin16": Bin16, "bin32": Bin32,
+	"ext8": Ext8, "ext16": Ext16, "ext32": Ext32,
+	"array16": Array16, "array32": Array32,
+	"map16": Map16, "map32": Map32,
+}
+
+// taggedFamilies maps each tag without a width to the type it holds.
+var taggedFamilies = map[string]Type{
+	"str": StrType, "bin": BinType, "ext": ExtensionType, "array": ArrayType, "map": MapType,
+}
+
+var (
+	taggedNames       = make(map[byte]string, len(taggedPrefixes))
+	taggedFamilyNames = make(map[Type]string, len(taggedFamilies))
+)
+
+func init() {
+	for name, prefix := range taggedPrefixes {
+		taggedNames[prefix] = name
+	}
+	for name, typ := range taggedFamilies {
+		taggedFamilyNames[typ] = name
+	}
+}
+
+// MarshalTaggedJSON converts a Node into tagged JSON, which
+// UnmarshalTaggedJSON converts back into a Node with exactly the same
+// msgpack encoding.
+func MarshalTaggedJSON(node Node) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeTagged(&buf, node); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeTagged(buf *bytes.Buffer, node Node) error {
+	switch n := node.(type) {
+	case *NilNode:
+		buf.WriteString("null")
+
+	case *BoolNode:
+		buf.WriteString(strconv.FormatBool(n.Value))
+
+	case *IntNode:
+		s := strconv.FormatInt(n.Approx, 10)
+		if n.Prefix == taggedMinIntPrefix(n.Approx) {
+			buf.WriteString(s)
+		} else {
+			writeTag(buf, taggedNames[n.Prefix], s)
+		}
+
+	case *UintNode:
+		s := strconv.FormatUint(n.Approx, 10)
+		min := byte(Uint64)
+		if n.Approx <= math.MaxInt64 {
+			min = taggedMinIntPrefix(int64(n.Approx))
+		}
+		if n.Prefix == min {
+			buf.WriteString(s)
+		} else {
+			writeTag(buf, taggedNames[n.Prefix], s)
+		}
+
+	case *FloatNode:
+		return writeTaggedFloat(buf, n)
+
+	case *StrNode:
+		valid := utf8.ValidString(n.Value)
+		name := taggedWidthName(n.Prefix, StrType, len(n.Value))
+		switch {
+		case valid && name == "str":
+			writeTaggedString(buf, n.Value)
+		case valid:
+			buf.WriteString(`{"$` + name + `":`)
+			writeTaggedString(buf, n.Value)
+			buf.WriteByte('}')
+		default:
+			writeTag(buf, name+"hex", `"`+hex.EncodeToString([]byte(n.Value))+`"`)
+		}
+
+	case *BinNode:
+		name := taggedWidthName(n.Prefix, BinType, len(n.Value))
+		writeTag(buf, name, `"`+hex.EncodeToString(n.Value)+`"`)
+
+	case *ExtensionNode:
+		ext := readExtension(n.Contents)
+		name := taggedWidthName(n.Prefix, ExtensionType, len(ext.Data))
+		writeTag(buf, name, fmt.Sprintf(`{"type":%d,"data":"%x"}`, ext.Type, ext.Data))
+
+	case *ArrayNode:
+		name := taggedWidthName(n.Prefix, ArrayType, len(n.Children))
+		if name != "array" {
+			buf.WriteString(`{"$` + name + `":`)
+		}
+		buf.WriteByte('[')
+		for i, c := range n.Children {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeTagged(buf, c); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		if name != "array" {
+			buf.WriteByte('}')
+		}
+
+	case *MapNode:
+		name := taggedWidthName(n.Prefix, MapType, len(n.Values))
+		if name == "map" && taggedPlainKeys(n) {
+			buf.WriteByte('{')
+			for i, kv := range n.Values {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				writeTaggedString(buf, kv.Key.(*StrNode).Value)
+				buf.WriteByte(':')
+				if err := writeTagged(buf, kv.Value); err != nil {
+					return err
+				}
+			}
+			buf.WriteByte('}')
+			return nil
+		}
+
+		buf.WriteString(`{"$` + name + `":[`)
+		for i, kv := range n.Values {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteByte('[')
+			if err := writeTagged(buf, kv.Key); err != nil {
+				return err
+			}
+			buf.WriteByte(',')
+			if err := writeTagged(buf, kv.Value); err != nil {
+				return err
+			}
+			buf.WriteByte(']')
+		}
+		buf.WriteString("]}")
+
+	default:
+		return fmt.Errorf("unsupported node type %T", node)
+	}
+	return nil
+}
+
+func writeTaggedFloat(buf *bytes.Buffer, n *FloatNode) error {
+	switch {
+	case n.Prefix == Float32 && len(n.Bits) == 4:
+		bits := byteOrder.Uint32(n.Bits)
+		f := float64(math.Float32frombits(bits))
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			writeTag(buf, "f32", fmt.Sprintf(`"0x%08x"`, bits))
+		} else {
+			writeTag(buf, "f32", strconv.FormatFloat(f, 'g', -1, 32))
+		}
+
+	case n.Prefix == Float64 && len(n.Bits) == 8:
+		bits := byteOrder.Uint64(n.Bits)
+		f := math.Float64frombits(bits)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			writeTag(buf, "f64", fmt.Sprintf(`"0x%016x"`, bits))
+			return nil
+		}
+		// Plain numbers need a fraction or exponent to be read as floats.
+		s := strconv.FormatFloat(f, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eE") {
+			s += ".0"
+		}
+		buf.WriteString(s)
+
+	default:
+		return fmt.Errorf("float prefix %02x has %d bits bytes", n.Prefix, len(n.Bits))
+	}
+	return nil
+}
+
+func writeTag(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(`{"$` + name + `":` + value + `}`)
+}
+
+func writeTaggedString(buf *bytes.Buffer, s string) {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	buf.Truncate(buf.Len() - 1) // Encode adds a newline
+}
+
+// taggedPlainKeys reports whether a map can be written as a plain object.
+func taggedPlainKeys(n *MapNode) bool {
+	for i, kv := range n.Values {
+		k, ok := kv.Key.(*StrNode)
+		if !ok || !utf8.ValidString(k.Value) || taggedWidthName(k.Prefix, StrType, len(k.Value)) != "str" {
+			return false
+		}
+		if i == 0 && strings.HasPrefix(k.Value, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// taggedWidthName returns the name of the tag for an object of type typ with
+// n bytes or elements: the bare type name if prefix is the smallest
+// encoding, and the name of its width otherwise.
+func taggedWidthName(prefix byte, typ Type, n int) string {
+	min := taggedMinPrefix(typ, n)
+	if prefix == min || (isfixstr(prefix) && isfixstr(min)) ||
+		(isfixarray(prefix) && isfixarray(min)) || (isfixmap(prefix) && isfixmap(min)) {
+		return taggedFamilyNames[typ]
+	}
+	return taggedNames[prefix]
+}
+
+func taggedMinIntPrefix(i int64) byte {
+	switch n := jsonIntNode(i, JSONIntMinimal).(type) {
+	case *IntNode:
+		return n.Prefix
+	case *UintNode:
+		return n.Prefix
+	}
+	return 0
+}
+
+// taggedMinPrefix returns the smallest encoding of an object of type typ
+// with n bytes or elements.
+func taggedMinPrefix(typ Type, n int) byte {
+	switch typ {
+	case StrType:
+		if n <= 31 {
+			return wfixstr(uint8(n))
+		}
+		return taggedSized(n, Str8, Str16, Str32)
+	case BinType:
+		return taggedSized(n, Bin8, Bin16, Bin32)
+	case ExtensionType:
+		switch n {
+		case 1:
+			return Fixext1
+		case 2:
+			return Fixext2
+		case 4:
+			return Fixext4
+		case 8:
+			return Fixext8
+		case 16:
+			return Fixext16
+		}
+		return taggedSized(n, Ext8, Ext16, Ext32)
+	case ArrayType:
+		if n <= 15 {
+			return wfixarray(uint8(n))
+		}
+		return taggedSized(n, Array16, Array16, Array32)
+	case MapType:
+		if n <= 15 {
+			return wfixmap(uint8(n))
+		}
+		return taggedSized(n, Map16, Map16, Map32)
+	}
+	return 0
+}
+
+func taggedSized(n int, p8, p16, p32 byte) byte {
+	switch {
+	case n <= math.MaxUint8:
+		return p8
+	case n <= math.MaxUint16:
+		return p16
+	default:
+		return p32
+	}
+}
+
+// taggedFits reports whether n bytes or elements fit in an object with the
+// given prefix.
+func taggedFits(prefix byte, n int) bool {
+	switch prefix {
+	case Str8, Bin8, Ext8:
+		return n <= math.MaxUint8
+	case Str16, Bin16, Ext16, Array16, Map16:
+		return n <= math.MaxUint16
+	default:
+		return uint64(n) <= math.MaxUint32
+	}
+}
+
+// UnmarshalTaggedJSON converts tagged JSON from MarshalTaggedJSON into a
+// Node. Plain JSON is converted as UnmarshalJSON would.
+func UnmarshalTaggedJSON(b []byte, extra bool) (Node, error) {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	node, err := taggedTokenToNode(decoder)
+	if err != nil {
+		return nil, err
+	}
+	if decoder.More() && !extra {
+		return nil, fmt.Errorf("extra bytes after JSON object")
+	}
+	return node, nil
+}
+
+// UnmarshalAllTaggedJSON converts a stream of tagged JSON values, such as
+// one MarshalTaggedJSON line per top level object, and returns the nodes in
+// order.
+func UnmarshalAllTaggedJSON(b []byte) ([]Node, error) {
+	var nodes []Node
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err == io.EOF {
+			return nodes, nil
+		} else if err != nil {
+			return nil, err
+		}
+		node, err := UnmarshalTaggedJSON(raw, false)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+}
+
+func taggedTokenToNode(decoder *json.Decoder) (Node, error) {
+	tok, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('['):
+		children, err := taggedElems(decoder)
+		if err != nil {
+			return nil, err
+		}
+		return taggedArray(children, taggedMinPrefix(ArrayType, len(children))), nil
+
+	case json.Delim('{'):
+		n := &MapNode{}
+		for i := 0; decoder.More(); i++ {
+			key, err := taggedString(decoder)
+			if err != nil {
+				return nil, err
+			}
+			if i == 0 && strings.HasPrefix(key, "$") {
+				node, err := taggedValue(decoder, key[1:])
+				if err != nil {
+					return nil, err
+				}
+				if decoder.More() {
+					return nil, fmt.Errorf("tag %q is not the only key in its object", key)
+				}
+				if err := taggedDelim(decoder, '}'); err != nil {
+					return nil, err
+				}
+				return node, nil
+			}
+
+			ck, err := jsonIntfToNode(key, &JSONDecodeOptions{})
+			if err != nil {
+				return nil, err
+			}
+			cv, err := taggedTokenToNode(decoder)
+			if err != nil {
+				return nil, err
+			}
+			n.Values = append(n.Values, KeyValueNode{Key: ck, Value: cv})
+		}
+		if err := taggedDelim(decoder, '}'); err != nil {
+			return nil, err
+		}
+		n.setCommon(taggedMinPrefix(MapType, len(n.Values)), 0)
+		n.Size = headerSize(n.Prefix)
+		return n, nil
+
+	default:
+		return jsonIntfToNode(tok, &JSONDecodeOptions{})
+	}
+}
+
+// taggedValue reads the value of the tag with the given name, without its
+// "$".
+func taggedValue(decoder *json.Decoder, name string) (Node, error) {
+	hexStr := false
+	if strings.HasPrefix(name, "str") && strings.HasSuffix(name, "hex") {
+		name, hexStr = strings.TrimSuffix(name, "hex"), true
+	}
+
+	prefix, ok := taggedPrefixes[name]
+	typ := sizes[prefix].typ
+	if !ok {
+		if typ, ok = taggedFamilies[name]; !ok {
+			return nil, fmt.Errorf("unknown tag %q", "$"+name)
+		}
+	}
+
+	switch typ {
+	case IntType, UintType:
+		tok, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		num, ok := tok.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("tag %q expected a number, found %v", "$"+name, tok)
+		}
+		bitSize := 8 * (int(sizes[prefix].size) - 1)
+		if typ == IntType {
+			i, err := strconv.ParseInt(num.String(), 10, bitSize)
+			if err != nil {
+				return nil, err
+			}
+			return jsonSignedNode(i, prefix), nil
+		}
+		u, err := strconv.ParseUint(num.String(), 10, bitSize)
+		if err != nil {
+			return nil, err
+		}
+		return jsonUintNode(u, prefix), nil
+
+	case Float32Type, Float64Type:
+		return taggedFloat(decoder, prefix)
+
+	case StrType, BinType:
+		s, err := taggedString(decoder)
+		if err != nil {
+			return nil, err
+		}
+		var data []byte
+		if typ == StrType && !hexStr {
+			data = []byte(s)
+		} else if data, err = hex.DecodeString(s); err != nil {
+			return nil, err
+		}
+		if prefix, err = taggedPrefix(name, prefix, typ, len(data)); err != nil {
+			return nil, err
+		}
+		if typ == StrType {
+			return &StrNode{commonNode: commonNode{Prefix: prefix, Size: headerSize(prefix)}, Value: string(data)}, nil
+		}
+		return &BinNode{commonNode: commonNode{Prefix: prefix, Size: headerSize(prefix)}, Value: data}, nil
+
+	case ExtensionType:
+		return taggedExt(decoder, name, prefix)
+
+	case ArrayType:
+		if err := taggedDelim(decoder, '['); err != nil {
+			return nil, err
+		}
+		children, err := taggedElems(decoder)
+		if err != nil {
+			return nil, err
+		}
+		if prefix, err = taggedPrefix(name, prefix, typ, len(children)); err != nil {
+			return nil, err
+		}
+		return taggedArray(children, prefix), nil
+
+	case MapType:
+		if err := taggedDelim(decoder, '['); err != nil {
+			return nil, err
+		}
+		n := &MapNode{}
+		for decoder.More() {
+			if err := taggedDelim(decoder, '['); err != nil {
+				return nil, err
+			}
+			pair, err := taggedElems(decoder)
+			if err != nil {
+				return nil, err
+			}
+			if len(pair) != 2 {
+				return nil, fmt.Errorf("tag %q expected [key, value] pairs, found %d elements", "$"+name, len(pair))
+			}
+			n.Values = append(n.Values, KeyValueNode{Key: pair[0], Value: pair[1]})
+		}
+		if err := taggedDelim(decoder, ']'); err != nil {
+			return nil, err
+		}
+		var err error
+		if prefix, err = taggedPrefix(name, prefix, typ, len(n.Values)); err != nil {
+			return nil, err
+		}
+		n.setCommon(prefix, headerSize(prefix))
+		return n, nil
+	}
+
+	return nil, fmt.Errorf("unknown tag %q", "$"+name)
+}
+
+// taggedPrefix returns the prefix for the tag with the given name and n bytes
+// or elements: the smallest encoding if the tag has no width, or the tag's
+// prefix if n fits in it.
+func taggedPrefix(name string, prefix byte, typ Type, n int) (byte, error) {
+	if _, ok := taggedFamilies[name]; ok {
+		return taggedMinPrefix(typ, n), nil
+	}
+	if !taggedFits(prefix, n) {
+		return 0, fmt.Errorf("tag %q can't hold %d bytes or elements", "$"+name, n)
+	}
+	return prefix, nil
+}
+
+func taggedFloat(decoder *json.Decoder, prefix byte) (Node, error) {
+	tok, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	bitSize := 64
+	if prefix == Float32 {
+		bitSize = 32
+	}
+
+	var bits uint64
+	switch v := tok.(type) {
+	case json.Number:
+		f, err := strconv.ParseFloat(v.String(), bitSize)
+		if err != nil {
+			return nil, err
+		}
+		if bitSize == 32 {
+			bits = uint64(math.Float32bits(float32(f)))
+		} else {
+			bits = math.Float64bits(f)
+		}
+	case string:
+		if !strings.HasPrefix(v, "0x") {
+			return nil, fmt.Errorf("float bits %q must start with 0x", v)
+		}
+		if bits, err = strconv.ParseUint(v[2:], 16, bitSize); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("expected a float, found %v", tok)
+	}
+
+	n := &FloatNode{commonNode: commonNode{Prefix: prefix, Size: int(sizes[prefix].size)}}
+	if bitSize == 32 {
+		n.Bits = make([]byte, 4)
+		byteOrder.PutUint32(n.Bits, uint32(bits))
+		n.Approx = float64(math.Float32frombits(uint32(bits)))
+	} else {
+		n.Bits = make([]byte, 8)
+		byteOrder.PutUint64(n.Bits, bits)
+		n.Approx = math.Float64frombits(bits)
+	}
+	return n, nil
+}
+
+func taggedExt(decoder *json.Decoder, name string, prefix byte) (Node, error) {
+	if err := taggedDelim(decoder, '{'); err != nil {
+		return nil, err
+	}
+	var typ int64
+	var data []byte
+	var hasType, hasData bool
+	for decoder.More() {
+		key, err := taggedString(decoder)
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case "type":
+			tok, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			num, ok := tok.(json.Number)
+			if !ok {
+				return nil, fmt.Errorf("extension type must be a number, found %v", tok)
+			}
+			if typ, err = strconv.ParseInt(num.String(), 10, 8); err != nil {
+				return nil, err
+			}
+			hasType = true
+		case "data":
+			s, err := taggedString(decoder)
+			if err != nil {
+				return nil, err
+			}
+			if data, err = hex.DecodeString(s); err != nil {
+				return nil, err
+			}
+			hasData = true
+		default:
+			return nil, fmt.Errorf("unknown extension field %q", key)
+		}
+	}
+	if err := taggedDelim(decoder, '}'); err != nil {
+		return nil, err
+	}
+	if !hasType || !hasData {
+		return nil, fmt.Errorf("tag %q requires type and data", "$"+name)
+	}
+
+	prefix, err := taggedPrefix(name, prefix, ExtensionType, len(data))
+	if err != nil {
+		return nil, err
+	}
+	return newExtensionNode(nil, writeExtension(prefix, int8(typ), data), nil)
+}
+
+// taggedElems reads values up to the end of the array whose opening bracket
+// has already been read.
+func taggedElems(decoder *json.Decoder) (elems []Node, err error) {
+	for decoder.More() {
+		n, err := taggedTokenToNode(decoder)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, n)
+	}
+	return elems, taggedDelim(decoder, ']')
+}
+
+func taggedArray(children []Node, prefix byte) Node {
+	n := &ArrayNode{Children: children}
+	n.setCommon(prefix, headerSize(prefix))
+	return n
+}
+
+func taggedString(decoder *json.Decoder) (string, error) {
+	tok, err := decoder.Token()
+	if err != nil {
+		return "", err
+	}
+	s, ok := tok.(string)
+	if !ok {
+		return "", fmt.Errorf("expected a string, found %v", tok)
+	}
+	return s, nil
+}
+
+func taggedDelim(decoder *json.Decoder, delim json.Delim) error {
+	tok, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("expected %v, found %v", delim, tok)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package msgplens
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTaggedJSONRoundTrip(t *testing.T) {
+	in := []byte{
+		0x92, 0x9f,
+		0x01, 0xff, Uint8, 0xc8, Uint16, 0x00, 0xc8, Int8, 0x05, Int16, 0xff, 0x00,
+		Uint64, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		Float32, 0x3f, 0xc0, 0x00, 0x00,
+		Float64, 0x7f, 0xf8, 0, 0, 0, 0, 0, 1,
+		Float64, 0x80, 0, 0, 0, 0, 0, 0, 0,
+		Str16, 0x00, 0x03, 'a', 'b', 'c',
+		0xa2, 0xc3, 0x28,
+		Bin8, 0x02, 0x01, 0xff,
+		Fixext1, 0x05, 'y',
+		Ext8, 0x01, 0xfe, 'z',
+		0x92, 0x93, // [{"b": nil, "a": true}, {1: "x"}, {"$x": []}]
+		0x82, 0xa1, 'b', Nil, 0xa1, 'a', True,
+		0x81, 0x01, 0xa1, 'x',
+		0x81, 0xa2, '$', 'x', 0x90,
+		Array16, 0x00, 0x01, Map16, 0x00, 0x00,
+	}
+
+	repr := NewRepresenter()
+	if err := WalkBytes(repr, in); err != nil {
+		t.Fatal(err)
+	}
+	tagged, err := MarshalTaggedJSON(repr.Nodes()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := `[[1,-1,200,{"$u16":200},{"$i8":5},-256,18446744073709551615,{"$f32":1.5},{"$f64":"0x7ff8000000000001"},-0.0,` +
+		`{"$str16":"abc"},{"$strhex":"c328"},{"$bin":"01ff"},{"$ext":{"type":5,"data":"79"}},{"$ext8":{"type":-2,"data":"7a"}}],` +
+		`[[{"b":null,"a":true},{"$map":[[1,"x"]]},{"$map":[["$x",[]]]}],{"$array16":[{"$map16":[]}]}]]`
+	if string(tagged) != exp {
+		t.Fatalf("%s\n!=\n%s", tagged, exp)
+	}
+
+	node, err := UnmarshalTaggedJSON(tagged, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := node.Msgpack(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), in) {
+		t.Fatalf("% x\n!=\n% x", out.Bytes(), in)
+	}
+}
+
+func TestUnmarshalAllTaggedJSON(t *testing.T) {
+	in := []byte{Uint16, 0x00, 0xc8, 0x91, 0xa1, 'a', Nil}
+
+	repr := NewRepresenter()
+	if err := WalkAllBytes(repr, in); err != nil {
+		t.Fatal(err)
+	}
+	var tagged []byte
+	for _, n := range repr.Nodes() {
+		line, err := MarshalTaggedJSON(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tagged = append(append(tagged, line...), '\n')
+	}
+
+	nodes, err := UnmarshalAllTaggedJSON(tagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 3 {
+		t.Fatalf("expected 3 nodes, found %d", len(nodes))
+	}
+	var out bytes.Buffer
+	for _, n := range nodes {
+		if err := n.Msgpack(&out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(out.Bytes(), in) {
+		t.Fatalf("% x\n!=\n% x", out.Bytes(), in)
+	}
+
+	if _, err := UnmarshalAllTaggedJSON([]byte(`1 {"$u8":256}`)); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestUnmarshalTaggedJSONError(t *testing.T) {
+	for _, in := range []string{
+		`{"$u8":256}`,
+		`{"$str8":"` + string(bytes.Repeat([]byte{'a'}, 256)) + `"}`,
+		`{"$nope":1}`,
+		`{"$bin":"01","x":1}`,
+		`{"$ext":{"type":1}}`,
+		`{"$map":[[1]]}`,
+	} {
+		if _, err := UnmarshalTaggedJSON([]byte(in), false); err == nil {
+			t.Fatalf("expected error for %s", in)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package msgplens
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ColorMode controls whether a Printer colors its output.
+type ColorMode int
+
+const (
+	// ColorAuto colors output if it is written to a terminal and the
+	// NO_COLOR environment variable is not set.
+	ColorAuto ColorMode = iota
+
+	// ColorAlways colors output regardless of where it is written.
+	ColorAlways
+
+	// ColorNever disables color.
+	ColorNever
+)
+
+// ParseColorMode parses "auto", "always" or "never".
+func ParseColorMode(s string) (ColorMode, error) {
+	switch s {
+	case "auto", "":
+		return ColorAuto, nil
+	case "always":
+		return ColorAlways, nil
+	case "never":
+		return ColorNever, nil
+	default:
+		return 0, fmt.Errorf("unknown color mode %q", s)
+	}
+}
+
+func (c ColorMode) enabled(out io.Writer) bool {
+	switch c {
+	case ColorAlways:
+		return true
+	case ColorNever:
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	f, ok := out.(*os.File)
+	if !ok {
+		return false
+	}
+	stat, err := f.Stat()
+	return err == nil && (stat.Mode()&os.ModeCharDevice) != 0
+}
+
+// Theme is a palette for Printer. Each field is an ANSI SGR parameter
+// string, such as "36", "1;4" or "38;5;208". An empty field leaves that part
+// of the output uncolored.
+type Theme struct {
+	AttrName  string // Attribute names, such as "at:" and "len:"
+	AttrValue string // Attribute values
+	KeyIndex  string // Array indexes and map entry numbers
+	KeyType   string // The K and V markers of map entries
+	Prefix    string // Prefix bytes
+	Type      string // Prefix names
+	Int       string
+	Float     string
+	String    string
+	Ext       string // Decoded extensions
+	Error     string
+}
+
+var (
+	// ThemeDark suits terminals with a dark background. It is the default.
+	ThemeDark = Theme{
+		AttrName:  sgr(darkGray),
+		AttrValue: sgr(lightGray),
+		KeyIndex:  sgr(lightMagenta),
+		KeyType:   sgr(magenta),
+		Prefix:    sgr(lightCyan),
+		Type:      sgr(cyan),
+		Int:       sgr(green),
+		Float:     sgr(yellow),
+		String:    sgr(lightBlue),
+		Ext:       sgr(lightGreen),
+		Error:     sgr(lightRed),
+	}
+
+	// ThemeLight suits terminals with a light background.
+	ThemeLight = Theme{
+		AttrName:  sgr(darkGray),
+		AttrValue: sgr(black),
+		KeyIndex:  sgr(magenta),
+		KeyType:   sgr(magenta, bold),
+		Prefix:    sgr(blue),
+		Type:      sgr(cyan),
+		Int:       sgr(green),
+		Float:     sgr(red),
+		String:    sgr(blue),
+		Ext:       sgr(green),
+		Error:     sgr(red, bold),
+	}
+
+	// Theme256 uses the 256 color palette.
+	Theme256 = Theme{
+		AttrName:  "38;5;243",
+		AttrValue: "38;5;250",
+		KeyIndex:  "38;5;213",
+		KeyType:   "38;5;170",
+		Prefix:    "38;5;117",
+		Type:      "38;5;73",
+		Int:       "38;5;114",
+		Float:     "38;5;221",
+		String:    "38;5;111",
+		Ext:       "38;5;156",
+		Error:     "38;5;203",
+	}
+
+	// ThemeMono uses only bold and underline.
+	ThemeMono = Theme{
+		KeyIndex: sgr(bold),
+		Type:     sgr(bold),
+		String:   sgr(underline),
+		Ext:      sgr(underline),
+		Error:    sgr(bold, underline),
+	}
+)
+
+// ThemeByName returns one of the built-in themes: "dark", "light", "256" or
+// "mono".
+func ThemeByName(name string) (Theme, bool) {
+	switch name {
+	case "dark":
+		return ThemeDark, true
+	case "light":
+		return ThemeLight, true
+	case "256":
+		return Theme256, true
+	case "mono":
+		return ThemeMono, true
+	}
+	return Theme{}, false
+}
+
+// ParseTheme applies a palette to base. The palette is a comma separated list
+// of field=sgr pairs using the lowercase Theme field names, for example
+// "int=32,string=38;5;117,error=1;31". An empty sgr removes the color.
+func ParseTheme(palette string, base Theme) (Theme, error) {
+	t := base
+	fields := map[string]*string{
+		"attrname":  &t.AttrName,
+		"attrvalue": &t.AttrValue,
+		"keyindex":  &t.KeyIndex,
+		"keytype":   &t.KeyType,
+		"prefix":    &t.Prefix,
+		"type":      &t.Type,
+		"int":       &t.Int,
+		"float":     &t.Float,
+		"string":    &t.String,
+		"ext":       &t.Ext,
+		"error":     &t.Error,
+	}
+	for _, part := range strings.Split(palette, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		eq := strings.IndexByte(part, '=')
+		if eq < 0 {
+			return Theme{}, fmt.Errorf("palette entry %q is not field=sgr", part)
+		}
+		name, code := strings.ToLower(part[:eq]), part[eq+1:]
+		field, ok := fields[name]
+		if !ok {
+			return Theme{}, fmt.Errorf("unknown palette field %q", name)
+		}
+		if strings.Trim(code, "0123456789;") != "" {
+			return Theme{}, fmt.Errorf("invalid SGR parameters %q for palette field %q", code, name)
+		}
+		*field = code
+	}
+	return t, nil
+}
+
+const (
+	bold      = 1
+	underline = 4
+)
+
+const (
+	black        = 30
+	red          = 31
+	green        = 32
+	yellow       = 33
+	blue         = 34
+	magenta      = 35
+	cyan         = 36
+	lightGray    = 37
+	darkGray     = 90
+	lightRed     = 91
+	lightGreen   = 92
+	lightYellow  = 93
+	lightBlue    = 94
+	lightMagenta = 95
+	lightCyan    = 96
+	white        = 97
+)
+
+func sgr(codes ...int) string {
+	strs := make([]string, len(codes))
+	for i, c := range codes {
+		strs[i] = strconv.Itoa(c)
+	}
+	return strings.Join(strs, ";")
+}
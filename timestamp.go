@@ -0,0 +1,58 @@
+package msgplens
+
+import "time"
+
+// TimestampType is the extension type of the msgpack Timestamp extension.
+const TimestampType int8 = -1
+
+// Timestamp decodes e as a msgpack Timestamp extension. ok is false if e is
+// not a Timestamp, or if its data is not in one of the three formats the spec
+// allows.
+func (e Extension) Timestamp() (t time.Time, ok bool) {
+	if e.Type != TimestampType {
+		return time.Time{}, false
+	}
+
+	var sec int64
+	var nsec uint32
+	switch len(e.Data) {
+	case 4:
+		sec = int64(byteOrder.Uint32(e.Data))
+	case 8:
+		v := byteOrder.Uint64(e.Data)
+		nsec, sec = uint32(v>>34), int64(v&0x3ffffffff)
+	case 12:
+		nsec, sec = byteOrder.Uint32(e.Data), int64(byteOrder.Uint64(e.Data[4:]))
+	default:
+		return time.Time{}, false
+	}
+	if nsec > 999999999 {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, int64(nsec)).UTC(), true
+}
+
+// writeTimestamp returns the full encoding of t as a Timestamp extension,
+// using the smallest of the three formats that can hold it.
+func writeTimestamp(t time.Time) []byte {
+	sec, nsec := t.Unix(), uint32(t.Nanosecond())
+	typ := TimestampType
+	switch {
+	case sec>>32 == 0 && nsec == 0:
+		b := []byte{Fixext4, byte(typ), 0, 0, 0, 0}
+		byteOrder.PutUint32(b[2:], uint32(sec))
+		return b
+
+	case sec>>34 == 0:
+		b := []byte{Fixext8, byte(typ), 0, 0, 0, 0, 0, 0, 0, 0}
+		byteOrder.PutUint64(b[2:], uint64(nsec)<<34|uint64(sec))
+		return b
+
+	default:
+		b := make([]byte, 15)
+		b[0], b[1], b[2] = Ext8, 12, byte(typ)
+		byteOrder.PutUint32(b[3:], nsec)
+		byteOrder.PutUint64(b[7:], uint64(sec))
+		return b
+	}
+}
@@ -0,0 +1,72 @@
+package msgplens
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimestamp(t *testing.T) {
+	for _, tc := range []struct {
+		time   time.Time
+		prefix byte
+	}{
+		{time.Unix(1, 0), Fixext4},
+		{time.Unix(1<<32-1, 0), Fixext4},
+		{time.Unix(1<<32, 0), Fixext8},
+		{time.Unix(1, 999999999), Fixext8},
+		{time.Unix(1<<34-1, 1), Fixext8},
+		{time.Unix(1<<34, 0), Ext8},
+		{time.Unix(-1, 5), Ext8},
+	} {
+		bts := writeTimestamp(tc.time)
+		if bts[0] != tc.prefix {
+			t.Fatalf("%v: prefix %s != %s", tc.time, prefixName(bts[0]), prefixName(tc.prefix))
+		}
+		result, ok := readExtension(bts).Timestamp()
+		if !ok || !result.Equal(tc.time) {
+			t.Fatalf("%v != %v", result, tc.time)
+		}
+	}
+
+	// Nanoseconds out of range:
+	if _, ok := readExtension([]byte{Fixext8, 0xff, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}).Timestamp(); ok {
+		t.Fatal("expected invalid timestamp")
+	}
+}
+
+func TestTimestampJSON(t *testing.T) {
+	ts := time.Date(2021, 2, 3, 4, 5, 6, 7, time.UTC)
+	in := append([]byte{0x92}, writeTimestamp(ts)...)
+	in = append(in, 0xa3, 'f', 'o', 'o')
+
+	enc := NewJSONEncoder()
+	if err := WalkBytes(enc, in); err != nil {
+		t.Fatal(err)
+	}
+	exp := `["2021-02-03T04:05:06.000000007Z","foo"]`
+	if enc.String() != exp {
+		t.Fatalf("%s != %s", enc.String(), exp)
+	}
+
+	node, err := UnmarshalJSONOptions([]byte(exp), JSONDecodeOptions{TimeLayout: time.RFC3339Nano})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := node.Msgpack(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), in) {
+		t.Fatalf("% x != % x", out.Bytes(), in)
+	}
+
+	var printed bytes.Buffer
+	if err := WalkBytes(NewPrinter(&printed), in); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(printed.String(), "2021-02-03T04:05:06.000000007Z") {
+		t.Fatalf("timestamp not printed:\n%s", printed.String())
+	}
+}